@@ -0,0 +1,139 @@
+package configuration
+
+import (
+	"reflect"
+	"sync"
+	"sync/atomic"
+)
+
+// config structs implementing Validator are validated before they are
+// published by a Binding
+type Validator interface {
+	Validate() error
+}
+
+// struct of type T which follows reloads, every reload sets a fresh T
+// with VarAt, validates it and publishes it at once. readers always get
+// a fully set struct, see Load
+type Binding[T any] struct {
+	prefix string
+	value  atomic.Pointer[T]
+	// removes the reload listener of the driver
+	remove func()
+
+	// guards the fields below, listeners are called without it
+	lock      sync.Mutex
+	err       error
+	listeners []func(old, new *T)
+}
+
+// bind the config under prefix to a T, see BindFrom. new values are
+// published on Reload and while Watch runs
+func BindAt[T any](prefix string) (*Binding[T], error) {
+	loadDriver()
+	return BindFrom[T](driver, prefix)
+}
+
+// bind the config of the driver under prefix to a T, the first value is
+// set from the current buffer and its error returned
+func BindFrom[T any](d *Driver, prefix string) (*Binding[T], error) {
+	return bind[T](d, prefix, nil)
+}
+
+// bind the config to the type of cfg, cfg is set from the same buffer
+// as the first value. the published values are fresh T's which share
+// nothing with cfg, so fields without a config value get their zero
+// value or tag default and changing cfg doesn't change Load
+func Bind[T any](cfg *T) (*Binding[T], error) {
+	loadDriver()
+	return bind(driver, "", cfg)
+}
+
+func bind[T any](d *Driver, prefix string, cfg *T) (*Binding[T], error) {
+	b := &Binding[T]{prefix: prefix}
+	buf := d.Buffer()
+	if err := b.load(buf, new(T)); err != nil {
+		return nil, err
+	}
+	if cfg != nil {
+		if err := buf.VarAt(prefix, cfg); err != nil {
+			return nil, err
+		}
+	}
+	b.remove = d.onChange(func(_, buf *TreeBuffer) {
+		b.load(buf, new(T))
+	})
+	return b, nil
+}
+
+// stop publishing the values of reloads, Load keeps the last value
+func (b *Binding[T]) Close() {
+	b.remove()
+}
+
+// the current value, it must not be changed
+func (b *Binding[T]) Load() *T {
+	return b.value.Load()
+}
+
+// error of the last reload, nil if its value was published. the
+// previous value is kept while it isn't nil
+func (b *Binding[T]) Err() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.err
+}
+
+// call fn with the old and new value every time a changed value is
+// published. fn is called after the value is published and may call the
+// methods of b
+func (b *Binding[T]) OnChange(fn func(old, new *T)) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.listeners = append(b.listeners, fn)
+}
+
+// set v from buf and publish it if it's valid and changed
+func (b *Binding[T]) load(buf *TreeBuffer, v *T) error {
+	old, err := b.publish(buf, v)
+	if err != nil || old == nil {
+		return err
+	}
+	b.lock.Lock()
+	listeners := make([]func(old, new *T), len(b.listeners))
+	copy(listeners, b.listeners)
+	b.lock.Unlock()
+	for _, fn := range listeners {
+		fn(old, v)
+	}
+	return nil
+}
+
+// publish v, the value it replaced is returned, nil for the first value
+// or if v isn't changed
+func (b *Binding[T]) publish(buf *TreeBuffer, v *T) (*T, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if err := buf.VarAt(b.prefix, v); err != nil {
+		b.err = err
+		return nil, err
+	}
+	if err := validate(v); err != nil {
+		b.err = err
+		return nil, err
+	}
+	b.err = nil
+	old := b.value.Load()
+	if old != nil && reflect.DeepEqual(old, v) {
+		return nil, nil
+	}
+	b.value.Store(v)
+	return old, nil
+}
+
+func validate(v interface{}) error {
+	if vr, ok := v.(Validator); ok {
+		return vr.Validate()
+	}
+	return nil
+}
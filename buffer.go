@@ -1,19 +1,73 @@
 package configuration
 
 import (
+	"encoding"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"reflect"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var (
 	errKeyNotFound = errors.New("cann't found the value with the key")
 	errType        = errors.New("cann't fetch the type")
+	errFileRef     = errors.New("cann't read the referenced file")
 )
 
+var (
+	durationType        = reflect.TypeOf(time.Duration(0))
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+// value prefix referencing a file whose content is the real value,
+// eg. db.password = @file:/run/secrets/db_password
+const fileRefPrefix = "@file:"
+
+// providers whose values may reference files. values of remote stores
+// (consul, http, the cache of them) and of mounted directories are taken
+// as is, anyone able to write them could read any local file otherwise
+var fileRefProviders = map[string]bool{"file": true, "dotenv": true}
+
+// whether the value of k may reference a file: values set by the program,
+// by trusted providers and by XXX_FILE environment variables
+func (n *node) fileRefAllowed(k string) bool {
+	chain := n.origins[k]
+	if len(chain) == 0 {
+		return true
+	}
+	o := chain[len(chain)-1]
+	if o.Provider == "env" {
+		return strings.HasSuffix(o.Source, envFileSuffix)
+	}
+	return len(o.Provider) == 0 || fileRefProviders[o.Provider]
+}
+
+// the value of the lower case key k, file references are resolved if allowed
+func (n *node) resolve(k, v string) (string, error) {
+	if !strings.HasPrefix(v, fileRefPrefix) || !n.fileRefAllowed(k) {
+		return v, nil
+	}
+	return resolveValue(v)
+}
+
+// resolve file reference value, other values are returned as is
+func resolveValue(v string) (string, error) {
+	if !strings.HasPrefix(v, fileRefPrefix) {
+		return v, nil
+	}
+	bts, err := ioutil.ReadFile(string(v[len(fileRefPrefix):]))
+	if err != nil {
+		return "", errFileRef
+	}
+	return strings.TrimRight(string(bts), "\r\n"), nil
+}
+
 type BufferError struct {
 	err error
 	msg string
@@ -34,106 +88,131 @@ func NewBufferError(err error, msg string) *BufferError {
 	return &BufferError{err, msg}
 }
 
+// keys are case insensitive, values are kept by lower case keys and the
+// names as set are kept for map keys and printing.
+// a loaded buffer is an immutable snapshot published through an atomic
+// pointer, reads take no locks. writes change a private draft copied
+// from the snapshot which the next read publishes as the new snapshot
 type TreeBuffer struct {
-	Data     map[string]string
-	Children map[string]*TreeBuffer
-	//lock for data map
-	DataLock     sync.RWMutex
-	ChildrenLock sync.RWMutex
+	snapshot atomic.Pointer[node]
+	// serializes writers, guards the fields below
+	lock  sync.Mutex
+	draft *node
+	epoch uint64
+	// origin of values set next, see SetOrigin
+	origin Origin
+	// see SetListFormat
+	listFormat ListFormat
+	// buffer and key path of a Sub view, secret marks of the view are
+	// marked on the parent too
+	parent *TreeBuffer
+	prefix string
 }
 
 func NewTreeBuffer() *TreeBuffer {
-	return &TreeBuffer{
-		Data:     make(map[string]string),
-		Children: make(map[string]*TreeBuffer),
-	}
+	return bufferOf(newNode(0))
 }
 
+// set value of the key path, see ParseKey. keys which aren't valid
+// paths are split at dots
 func (t *TreeBuffer) Set(key, value string) {
-	value = strings.Trim(value, `"`)
-	var ks []string
-	if strings.Count(key, `"`) == 2 && strings.HasSuffix(key, `"`) {
-		i := strings.LastIndex(string(key[:len(key)-1]), `"`)
-		kt := string(key[:i])
-		kt = strings.TrimRight(kt, ".")
-		ks = strings.Split(kt, `.`)
-		ks = append(ks, string(key[i+1:len(key)-1]))
-	} else {
+	ks, err := ParseKey(key)
+	if err != nil {
 		ks = strings.Split(key, ".")
 	}
-	t.SetIn(ks, value)
+	quoted := ""
+	if v := unquoteValue(value); v != value {
+		quoted, value = value, v
+	}
+	t.setIn(ks, value, quoted)
+}
+
+// strip the quotes of a quoted value, values with inner quotes like
+// the list "a;b";"c" are kept. the list getters split the quoted value,
+// so "a;b" is one element
+func unquoteValue(v string) string {
+	if len(v) >= 2 && v[0] == '"' && v[len(v)-1] == '"' && !strings.Contains(v[1:len(v)-1], `"`) {
+		return v[1 : len(v)-1]
+	}
+	return v
 }
 
 func (t *TreeBuffer) SetIn(ks []string, value string) {
-	if len(ks) == 1 {
-		t.DataLock.Lock()
-		defer t.DataLock.Unlock()
-		t.Data[ks[0]] = value
-	} else if len(ks) > 1 {
-		var (
-			tb *TreeBuffer
-			ok bool
-		)
-		t.ChildrenLock.Lock()
-		defer t.ChildrenLock.Unlock()
-		if tb, ok = t.Children[ks[0]]; !ok {
-			tb = NewTreeBuffer()
-			t.Children[ks[0]] = tb
-		}
-		tb.SetIn(ks[1:], value)
+	t.setIn(ks, value, "")
+}
+
+// SetIn with the value as quoted before Set removed the quotes
+func (t *TreeBuffer) setIn(ks []string, value, quoted string) {
+	if len(ks) == 0 {
+		return
 	}
+	t.write(func(root *node) {
+		n := root
+		for _, k := range ks[:len(ks)-1] {
+			n = n.child(k, t.epoch)
+		}
+		n.addOrigin(ks[len(ks)-1], t.origin)
+		n.setData(ks[len(ks)-1], value)
+		if len(quoted) > 0 {
+			n.setQuoted(ks[len(ks)-1], quoted)
+		}
+	})
 }
 
 func (t *TreeBuffer) Delete(key string) *BufferError {
-	ks := strings.Split(key, ".")
-	b, err := t.GetBuffer(ks)
-	if err != nil {
-		return NewBufferError(err, key)
+	ks, berr := lookupKey(key)
+	if berr != nil {
+		return berr
+	}
+	if t.view().find(ks[:len(ks)-1]) == nil {
+		return NewBufferError(errKeyNotFound, key)
 	}
-	delete(b.Data, ks[len(ks)-1])
+	t.write(func(root *node) {
+		n := root
+		for _, k := range ks[:len(ks)-1] {
+			if _, ok := n.children[k]; !ok {
+				return
+			}
+			n = n.child(k, t.epoch)
+		}
+		k := ks[len(ks)-1]
+		delete(n.data, k)
+		delete(n.dataNames, k)
+		delete(n.quoted, k)
+		delete(n.origins, k)
+	})
 	return nil
 }
 
 func (t *TreeBuffer) GetIn(ks []string) (string, error) {
-	if len(ks) == 1 {
-		t.DataLock.RLock()
-		defer t.DataLock.RUnlock()
-		if s, ok := t.Data[ks[0]]; ok {
-			return s, nil
-		} else {
-			return "", errKeyNotFound
-		}
-	} else if len(ks) > 1 {
-		t.ChildrenLock.RLock()
-		defer t.ChildrenLock.RUnlock()
-		if tb, ok := t.Children[ks[0]]; ok {
-			return tb.GetIn(ks[1:])
-		} else {
-			return "", errKeyNotFound
-		}
-	} else {
+	if len(ks) == 0 {
 		return "", errKeyNotFound
 	}
+	if p := t.view().find(ks[:len(ks)-1]); p != nil {
+		k := strings.ToLower(ks[len(ks)-1])
+		if v, ok := p.data[k]; ok {
+			return p.resolve(k, v)
+		}
+	}
+	return "", errKeyNotFound
 }
 
+// snapshot of the buffer holding the last key of the path
 func (t *TreeBuffer) GetBuffer(ks []string) (*TreeBuffer, error) {
-	if len(ks) == 1 {
-		return t, nil
-	} else if len(ks) > 1 {
-		t.ChildrenLock.RLock()
-		defer t.ChildrenLock.RUnlock()
-		if tb, ok := t.Children[ks[0]]; ok {
-			return tb.GetBuffer(ks[1:])
-		} else {
-			return nil, errKeyNotFound
-		}
-	} else {
+	if len(ks) == 0 {
 		return nil, errKeyNotFound
 	}
+	if n := t.view().find(ks[:len(ks)-1]); n != nil {
+		return t.derive(n), nil
+	}
+	return nil, errKeyNotFound
 }
 
 func (t *TreeBuffer) GetString(key, def string) (string, *BufferError) {
-	ks := strings.Split(key, ".")
+	ks, berr := lookupKey(key)
+	if berr != nil {
+		return "", berr
+	}
 	s, err := t.GetIn(ks)
 	if err != nil {
 		if err == errKeyNotFound && len(def) > 0 {
@@ -145,82 +224,149 @@ func (t *TreeBuffer) GetString(key, def string) (string, *BufferError) {
 	}
 }
 
+// value of key as set, file references aren't resolved
+func (t *TreeBuffer) GetRaw(key string) (string, *BufferError) {
+	ks, berr := lookupKey(key)
+	if berr != nil {
+		return "", berr
+	}
+	if p := t.view().find(ks[:len(ks)-1]); p != nil {
+		if v, ok := p.data[strings.ToLower(ks[len(ks)-1])]; ok {
+			return v, nil
+		}
+	}
+	return "", NewBufferError(errKeyNotFound, key)
+}
+
+// elements of a list value or of indexed children (key.0, key.1, ...),
+// list values are split with the format set by SetListFormat
 func (t *TreeBuffer) GetStrings(key, def string) ([]string, *BufferError) {
-	ks := strings.Split(key, ".")
-	tb, err := t.GetBuffer(ks)
-	if err != nil {
-		if err == errKeyNotFound && len(def) > 0 {
-			return strings.Split(def, ";"), nil
-		}
-		return []string{}, NewBufferError(err, key)
-	}
-	tb.DataLock.RLock()
-	defer tb.DataLock.RUnlock()
-	if v, ok := tb.Data[ks[len(ks)-1]]; ok {
-		return strings.Split(v, ";"), nil
-	}
-	tb.ChildrenLock.RLock()
-	defer tb.ChildrenLock.RUnlock()
-	if tbc, ok := tb.Children[ks[len(ks)-1]]; ok {
-		rets := make([]string, len(tbc.Data))
-		tbc.DataLock.RLock()
-		defer tbc.DataLock.RUnlock()
-		for i := 0; i < len(tbc.Data); i++ {
-			if s, ok := tbc.Data[fmt.Sprintf("%v", i)]; ok {
+	return t.getStrings(key, def, t.currentListFormat())
+}
+
+// GetStrings with list format f
+func (t *TreeBuffer) GetStringsWith(key, def string, f ListFormat) ([]string, *BufferError) {
+	return t.getStrings(key, def, f)
+}
+
+func (t *TreeBuffer) getStrings(key, def string, f ListFormat) ([]string, *BufferError) {
+	ks, berr := lookupKey(key)
+	if berr != nil {
+		return []string{}, berr
+	}
+	last := ks[len(ks)-1]
+	p := t.view().find(ks[:len(ks)-1])
+	if p == nil {
+		if len(def) > 0 {
+			return f.Split(def), nil
+		}
+		return []string{}, NewBufferError(errKeyNotFound, key)
+	}
+	if v, ok := p.data[last]; ok {
+		if q, ok := p.quoted[last]; ok {
+			return f.Split(q), nil
+		}
+		v, err := p.resolve(last, v)
+		if err != nil {
+			return []string{}, NewBufferError(err, key)
+		}
+		return f.Split(v), nil
+	}
+	if c, ok := p.children[last]; ok {
+		rets := make([]string, len(c.data))
+		for i := 0; i < len(c.data); i++ {
+			if s, ok := c.data[strconv.Itoa(i)]; ok {
+				s, err := c.resolve(strconv.Itoa(i), s)
+				if err != nil {
+					return []string{}, NewBufferError(err, fmt.Sprintf("%v.%v", key, i))
+				}
+				if f.Trim {
+					s = strings.TrimSpace(s)
+				}
 				rets[i] = s
 			} else {
 				return []string{}, NewBufferError(errKeyNotFound, key)
 			}
 		}
 		return rets, nil
+	} else if len(def) > 0 {
+		return f.Split(def), nil
 	} else {
 		return []string{}, NewBufferError(errKeyNotFound, key)
 	}
 }
 
 func (t *TreeBuffer) GetMap(key, def string) (map[string]string, *BufferError) {
-	ks := strings.Split(key, ".")
-	tb, err := t.GetBuffer(ks)
-	if err != nil {
-		if err == errKeyNotFound && len(def) > 0 {
-			ss := strings.Split(def, ";") //分号
-			m := make(map[string]string)
-			for _, s := range ss {
-				kvs := strings.SplitN(s, ":", 2) //冒号
-				if len(kvs) < 2 {
-					m[kvs[0]] = ""
-				} else {
-					m[kvs[0]] = kvs[1]
-				}
-			}
-			return m, nil
+	ks, berr := lookupKey(key)
+	if berr != nil {
+		return map[string]string{}, berr
+	}
+	p := t.view().find(ks[:len(ks)-1])
+	if p == nil {
+		if len(def) > 0 {
+			return t.mapDefault(key, def)
 		}
-		return map[string]string{}, NewBufferError(err, key)
+		return map[string]string{}, NewBufferError(errKeyNotFound, key)
 	}
-	tb.ChildrenLock.RLock()
-	defer tb.ChildrenLock.RUnlock()
-	if ttb, ok := tb.Children[ks[len(ks)-1]]; ok {
-		ttb.DataLock.RLock()
-		defer ttb.DataLock.RUnlock()
-		return ttb.Data, nil
+	if c, ok := p.children[ks[len(ks)-1]]; ok {
+		m := make(map[string]string, len(c.data))
+		for k, v := range c.data {
+			v, err := c.resolve(k, v)
+			if err != nil {
+				return nil, NewBufferError(err, key+"."+c.dataName(k))
+			}
+			m[c.dataName(k)] = v
+		}
+		return m, nil
+	} else if len(def) > 0 {
+		return t.mapDefault(key, def)
 	} else {
 		return nil, NewBufferError(errKeyNotFound, key)
 	}
 }
 
-// get map child
+// default map of key:value;key:value pairs or a json object literal
+func (t *TreeBuffer) mapDefault(key, def string) (map[string]string, *BufferError) {
+	m := make(map[string]string)
+	if strings.HasPrefix(strings.TrimSpace(def), "{") {
+		var vs map[string]json.RawMessage
+		if err := json.Unmarshal([]byte(def), &vs); err != nil {
+			return map[string]string{}, NewBufferError(errTag, key+" default("+def+")")
+		}
+		for k, raw := range vs {
+			var s string
+			if err := json.Unmarshal(raw, &s); err != nil {
+				s = string(raw)
+			}
+			m[k] = s
+		}
+		return m, nil
+	}
+	ss := strings.Split(def, ";") //分号
+	for _, s := range ss {
+		kvs := strings.SplitN(s, ":", 2) //冒号
+		if len(kvs) < 2 {
+			m[kvs[0]] = ""
+		} else {
+			m[kvs[0]] = kvs[1]
+		}
+	}
+	return m, nil
+}
+
+// get map child, the children are snapshots and changing them doesn't
+// change t
 func (t *TreeBuffer) GetMapChild(key string) (map[string]*TreeBuffer, *BufferError) {
-	ks := strings.Split(key, ".")
-	tb, err := t.GetBuffer(ks)
-	if err != nil {
-		return nil, NewBufferError(err, key)
+	ks, berr := lookupKey(key)
+	if berr != nil {
+		return nil, berr
 	}
-	tb.ChildrenLock.RLock()
-	defer tb.ChildrenLock.RUnlock()
-	if ttb, ok := tb.Children[ks[len(ks)-1]]; ok {
-		ttb.ChildrenLock.RLock()
-		defer ttb.ChildrenLock.RUnlock()
-		return ttb.Children, nil
+	if n := t.view().find(ks); n != nil {
+		m := make(map[string]*TreeBuffer, len(n.children))
+		for k, c := range n.children {
+			m[n.childName(k)] = t.derive(c)
+		}
+		return m, nil
 	}
 	return nil, NewBufferError(errKeyNotFound, key)
 }
@@ -231,7 +377,7 @@ func (t *TreeBuffer) GetInt(key, def string) (int, *BufferError) {
 		return 0, err
 	}
 	if i64, err := strconv.ParseInt(s, 10, 32); err != nil {
-		return 0, NewBufferError(errType, key)
+		return 0, t.typeError(key, s)
 	} else {
 		return int(i64), nil
 	}
@@ -245,7 +391,7 @@ func (t *TreeBuffer) GetInts(key, def string) ([]int, *BufferError) {
 	rets := make([]int, len(ss))
 	for i, s := range ss {
 		if i64, err := strconv.ParseInt(s, 10, 32); err != nil {
-			return []int{}, NewBufferError(errType, key)
+			return []int{}, t.typeError(key, s)
 		} else {
 			rets[i] = int(i64)
 		}
@@ -259,21 +405,49 @@ func (t *TreeBuffer) GetInt64(key, def string) (int64, *BufferError) {
 		return 0, err
 	}
 	if i64, err := strconv.ParseInt(s, 10, 64); err != nil {
-		return 0, NewBufferError(errType, key)
+		return 0, t.typeError(key, s)
 	} else {
 		return i64, nil
 	}
 }
 
+func (t *TreeBuffer) GetUint64(key, def string) (uint64, *BufferError) {
+	s, err := t.GetString(key, def)
+	if err != nil {
+		return 0, err
+	}
+	if u64, err := strconv.ParseUint(s, 10, 64); err != nil {
+		return 0, t.typeError(key, s)
+	} else {
+		return u64, nil
+	}
+}
+
+func (t *TreeBuffer) GetDuration(key, def string) (time.Duration, *BufferError) {
+	s, err := t.GetString(key, def)
+	if err != nil {
+		return 0, err
+	}
+	if d, err := time.ParseDuration(s); err != nil {
+		return 0, t.typeError(key, s)
+	} else {
+		return d, nil
+	}
+}
+
 func (t *TreeBuffer) GetInt64s(key, def string) ([]int64, *BufferError) {
-	ss, err := t.GetStrings(key, def)
+	return t.getInt64s(key, def, t.currentListFormat())
+}
+
+func (t *TreeBuffer) getInt64s(key, def string, f ListFormat) ([]int64, *BufferError) {
+	ss, err := t.getStrings(key, def, f)
 	if err != nil {
 		return []int64{}, err
 	}
 	rets := make([]int64, len(ss))
 	for i, s := range ss {
 		if i64, err := strconv.ParseInt(s, 10, 64); err != nil {
-			return []int64{}, NewBufferError(errType, key)
+			return []int64{}, t.typeError(key, s)
 		} else {
 			rets[i] = i64
 		}
@@ -281,6 +455,42 @@ func (t *TreeBuffer) GetInt64s(key, def string) ([]int64, *BufferError) {
 	return rets, nil
 }
 
+func (t *TreeBuffer) GetUint64s(key, def string) ([]uint64, *BufferError) {
+	return t.getUint64s(key, def, t.currentListFormat())
+}
+
+func (t *TreeBuffer) getUint64s(key, def string, f ListFormat) ([]uint64, *BufferError) {
+	ss, err := t.getStrings(key, def, f)
+	if err != nil {
+		return []uint64{}, err
+	}
+	rets := make([]uint64, len(ss))
+	for i, s := range ss {
+		if u64, err := strconv.ParseUint(s, 10, 64); err != nil {
+			return []uint64{}, t.typeError(key, s)
+		} else {
+			rets[i] = u64
+		}
+	}
+	return rets, nil
+}
+
+func (t *TreeBuffer) getDurations(key, def string, f ListFormat) ([]time.Duration, *BufferError) {
+	ss, err := t.getStrings(key, def, f)
+	if err != nil {
+		return []time.Duration{}, err
+	}
+	rets := make([]time.Duration, len(ss))
+	for i, s := range ss {
+		if d, err := time.ParseDuration(s); err != nil {
+			return []time.Duration{}, t.typeError(key, s)
+		} else {
+			rets[i] = d
+		}
+	}
+	return rets, nil
+}
+
 func (t *TreeBuffer) convertBool(s string) bool {
 	if s == "1" || s == "T" || s == "t" || strings.ToLower(s) == "true" {
 		return true
@@ -298,7 +508,11 @@ func (t *TreeBuffer) GetBool(key, def string) (bool, *BufferError) {
 }
 
 func (t *TreeBuffer) GetBools(key, def string) ([]bool, *BufferError) {
-	ss, err := t.GetStrings(key, def)
+	return t.getBools(key, def, t.currentListFormat())
+}
+
+func (t *TreeBuffer) getBools(key, def string, f ListFormat) ([]bool, *BufferError) {
+	ss, err := t.getStrings(key, def, f)
 	if err != nil {
 		return []bool{}, err
 	}
@@ -315,21 +529,25 @@ func (t *TreeBuffer) GetFloat32(key, def string) (float32, *BufferError) {
 		return 0, err
 	}
 	if f64, err := strconv.ParseFloat(s, 32); err != nil {
-		return 0, NewBufferError(errType, key)
+		return 0, t.typeError(key, s)
 	} else {
 		return float32(f64), nil
 	}
 }
 
 func (t *TreeBuffer) GetFloat32s(key, def string) ([]float32, *BufferError) {
-	ss, err := t.GetStrings(key, def)
+	return t.getFloat32s(key, def, t.currentListFormat())
+}
+
+func (t *TreeBuffer) getFloat32s(key, def string, f ListFormat) ([]float32, *BufferError) {
+	ss, err := t.getStrings(key, def, f)
 	if err != nil {
 		return []float32{}, err
 	}
 	rets := make([]float32, len(ss))
 	for i, s := range ss {
 		if f64, err := strconv.ParseFloat(s, 32); err != nil {
-			return []float32{}, NewBufferError(errType, key)
+			return []float32{}, t.typeError(key, s)
 		} else {
 			rets[i] = float32(f64)
 		}
@@ -343,21 +561,25 @@ func (t *TreeBuffer) GetFloat64(key, def string) (float64, *BufferError) {
 		return 0, err
 	}
 	if f64, err := strconv.ParseFloat(s, 64); err != nil {
-		return 0, NewBufferError(errType, key)
+		return 0, t.typeError(key, s)
 	} else {
 		return f64, nil
 	}
 }
 
 func (t *TreeBuffer) GetFloat64s(key, def string) ([]float64, *BufferError) {
-	ss, err := t.GetStrings(key, def)
+	return t.getFloat64s(key, def, t.currentListFormat())
+}
+
+func (t *TreeBuffer) getFloat64s(key, def string, f ListFormat) ([]float64, *BufferError) {
+	ss, err := t.getStrings(key, def, f)
 	if err != nil {
 		return []float64{}, err
 	}
 	rets := make([]float64, len(ss))
 	for i, s := range ss {
 		if f64, err := strconv.ParseFloat(s, 64); err != nil {
-			return []float64{}, NewBufferError(errType, key)
+			return []float64{}, t.typeError(key, s)
 		} else {
 			rets[i] = f64
 		}
@@ -369,12 +591,28 @@ func (t *TreeBuffer) GetFloat64s(key, def string) ([]float64, *BufferError) {
 // struct pointer
 // struct slice
 func (t *TreeBuffer) Var(o interface{}) error {
+	return t.VarAt("", o)
+}
+
+// Var with the conf tags of o relative to prefix,
+// eg. VarAt("wx.oracle_backup", &pool) reads wx.oracle_backup.host
+func (t *TreeBuffer) VarAt(prefix string, o interface{}) error {
 	ot := reflect.TypeOf(o)
 	ov := reflect.ValueOf(o)
 	if (ot.Kind() == reflect.Ptr && ot.Elem().Kind() == reflect.Struct) ||
 		(ot.Kind() == reflect.Array && ot.Elem().Kind() == reflect.Struct) ||
 		(ot.Kind() == reflect.Array && ot.Elem().Kind() == reflect.Ptr && ot.Elem().Elem().Kind() == reflect.Struct) {
-		e := t.varSet(ot.Elem(), ov.Elem(), "")
+		// read one snapshot, secret tags are marked on t afterwards
+		root := t.view()
+		snap := t.derive(root)
+		e := snap.varSet(ot.Elem(), ov.Elem(), prefix)
+		if n := snap.view(); n != root {
+			for k := range n.secrets {
+				if !root.secrets[k] {
+					t.MarkSecret(k)
+				}
+			}
+		}
 		if e != nil {
 			return errors.New(e.Error())
 		} else {
@@ -385,16 +623,70 @@ func (t *TreeBuffer) Var(o interface{}) error {
 	}
 }
 
+// view of the keys under prefix, getters and Var of the view resolve
+// keys relative to prefix. the view is a snapshot of t, later changes
+// of t aren't visible and changes of the view don't change t, except
+// secret marks which are marked on t with the prefix. a missing prefix
+// is an empty view
+func (t *TreeBuffer) Sub(prefix string) *TreeBuffer {
+	if len(prefix) == 0 {
+		return t
+	}
+	ks, berr := lookupKey(prefix)
+	if berr != nil {
+		return t.derive(newNode(0))
+	}
+	root := t.view()
+	sub := root.find(ks)
+	if sub == nil {
+		return t.subView(newNode(0), ks)
+	}
+	// secret marks are kept by full key, mark them relative on the view
+	pre := JoinKey(ks...) + "."
+	sub = sub.copy(0)
+	sub.secrets = nil
+	for k := range root.secrets {
+		if strings.HasPrefix(k, pre) {
+			if sub.secrets == nil {
+				sub.secrets = make(map[string]bool)
+			}
+			sub.secrets[k[len(pre):]] = true
+		}
+	}
+	return t.subView(sub, ks)
+}
+
+func (t *TreeBuffer) subView(n *node, ks []string) *TreeBuffer {
+	v := t.derive(n)
+	v.parent = t
+	v.prefix = JoinKey(ks...)
+	return v
+}
+
+// copy of the buffer with its values, secret marks and origins, changes
+// of the copy and of t don't affect each other. the current snapshot is
+// shared and copied on write
+func (t *TreeBuffer) Clone() *TreeBuffer {
+	c := t.derive(t.view())
+	c.origin = t.currentOrigin()
+	return c
+}
+
 func (this *TreeBuffer) hasChildBuffer(key string) bool {
-	ks := strings.Split(key, ".")
-	b, err := this.GetBuffer(ks)
-	if err != nil {
+	ks, berr := lookupKey(key)
+	if berr != nil {
 		return false
 	}
-	b.ChildrenLock.RLock()
-	defer b.ChildrenLock.RUnlock()
-	_, ok := b.Children[ks[len(ks)-1]]
-	return ok
+	return this.view().find(ks) != nil
+}
+
+// the buffer struct slices and maps of key are read from, a buffer
+// holding the json literal default if key has no children
+func (this *TreeBuffer) defaultSource(key, def string) (*TreeBuffer, *BufferError) {
+	if len(def) == 0 || this.hasChildBuffer(key) {
+		return this, nil
+	}
+	return jsonDefault(key, def)
 }
 
 func (this *TreeBuffer) varSet(ot reflect.Type, ov reflect.Value, ptag string) *BufferError {
@@ -409,25 +701,46 @@ func (this *TreeBuffer) varSet(ot reflect.Type, ov reflect.Value, ptag string) *
 			(oti.Type.Kind() == reflect.Ptr && oti.Type.Elem().Kind() == reflect.Struct)) {
 			continue
 		}
-		confTag = strings.ToLower(confTag)
-		confTags := strings.Split(confTag, ",")
-		omit := false
-		def := ""
-		for _, t := range confTags {
-			if t == "omit" {
-				omit = true
-			} else if strings.HasPrefix(t, "default(") {
-				t = string(t[len("default("):])
-				t = string(t[:len(t)-1])
-				def = t
-			} else {
-				confTag = t
-			}
+		// keys are case insensitive, default values keep their case
+		opts, terr := parseTag(confTag)
+		if terr != nil {
+			return NewBufferError(terr, fmt.Sprintf("%v `conf:%q`", oti.Name, confTag))
+		}
+		confTag = opts.key
+		omit, def := opts.omit, opts.def
+		lf := this.currentListFormat()
+		if opts.hasSep {
+			lf.Sep = opts.sep
+		}
+		if opts.trim {
+			lf.Trim = true
 		}
 		ptag = strings.TrimRight(ptag, ".")
 		if len(ptag) > 0 {
 			confTag = ptag + "." + confTag
 		}
+		if opts.secret {
+			this.MarkSecret(confTag)
+		}
+		// default() sets the zero value if the key is missing
+		if opts.hasDef && len(def) == 0 && !this.Has(confTag) {
+			ovi.Set(reflect.Zero(oti.Type))
+			continue
+		}
+		// custom decoders like time.Time or net.IP
+		if reflect.PtrTo(oti.Type).Implements(textUnmarshalerType) {
+			v, err := this.GetString(confTag, def)
+			if IsKeyNotFound(err) && omit {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if ovi.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(v)) != nil {
+				return this.typeError(confTag, v)
+			}
+			continue
+		}
 		switch oti.Type.Kind() {
 		case reflect.String:
 			v, err := this.GetString(confTag, def)
@@ -448,14 +761,37 @@ func (this *TreeBuffer) varSet(ot reflect.Type, ov reflect.Value, ptag string) *
 			}
 			ovi.SetBool(v)
 		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-			v, err := this.GetInt64(confTag, def)
+			var v int64
+			var err *BufferError
+			if oti.Type == durationType {
+				var d time.Duration
+				d, err = this.GetDuration(confTag, def)
+				v = int64(d)
+			} else {
+				v, err = this.GetInt64(confTag, def)
+			}
 			if IsKeyNotFound(err) && omit {
 				break
 			}
 			if err != nil {
 				return err
 			}
-			ovi.SetInt(int64(v))
+			if ovi.OverflowInt(v) {
+				return this.typeError(confTag, strconv.FormatInt(v, 10))
+			}
+			ovi.SetInt(v)
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			v, err := this.GetUint64(confTag, def)
+			if IsKeyNotFound(err) && omit {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			if ovi.OverflowUint(v) {
+				return this.typeError(confTag, strconv.FormatUint(v, 10))
+			}
+			ovi.SetUint(v)
 		case reflect.Float32, reflect.Float64:
 			v, err := this.GetFloat64(confTag, def)
 			if IsKeyNotFound(err) && omit {
@@ -468,72 +804,103 @@ func (this *TreeBuffer) varSet(ot reflect.Type, ov reflect.Value, ptag string) *
 		case reflect.Slice:
 			switch oti.Type.Elem().Kind() {
 			case reflect.String:
-				v, err := this.GetStrings(confTag, def)
+				v, err := this.getStrings(confTag, def, lf)
 				if IsKeyNotFound(err) && omit {
 					break
 				}
 				if err != nil {
 					return err
 				}
-				ovi.Set(reflect.ValueOf(v))
+				ovi.Set(reflect.ValueOf(v).Convert(oti.Type))
 			case reflect.Bool:
-				v, err := this.GetBools(confTag, def)
+				v, err := this.getBools(confTag, def, lf)
 				if IsKeyNotFound(err) && omit {
 					break
 				}
 				if err != nil {
 					return err
 				}
-				ovi.Set(reflect.ValueOf(v))
+				ovi.Set(reflect.ValueOf(v).Convert(oti.Type))
 			case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-				v, err := this.GetInt64s(confTag, def)
+				var v []int64
+				var err *BufferError
+				if oti.Type.Elem() == durationType {
+					var ds []time.Duration
+					ds, err = this.getDurations(confTag, def, lf)
+					for _, d := range ds {
+						v = append(v, int64(d))
+					}
+				} else {
+					v, err = this.getInt64s(confTag, def, lf)
+				}
 				if IsKeyNotFound(err) && omit {
 					break
 				}
 				if err != nil {
 					return err
 				}
-				ovi.Set(reflect.ValueOf(v))
+				ovitemp := reflect.MakeSlice(oti.Type, len(v), len(v))
+				for i, n := range v {
+					if ovitemp.Index(i).OverflowInt(n) {
+						return this.typeError(fmt.Sprintf("%v.%v", confTag, i), strconv.FormatInt(n, 10))
+					}
+					ovitemp.Index(i).SetInt(n)
+				}
+				ovi.Set(ovitemp)
+			case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+				v, err := this.getUint64s(confTag, def, lf)
+				if IsKeyNotFound(err) && omit {
+					break
+				}
+				if err != nil {
+					return err
+				}
+				ovitemp := reflect.MakeSlice(oti.Type, len(v), len(v))
+				for i, n := range v {
+					if ovitemp.Index(i).OverflowUint(n) {
+						return this.typeError(fmt.Sprintf("%v.%v", confTag, i), strconv.FormatUint(n, 10))
+					}
+					ovitemp.Index(i).SetUint(n)
+				}
+				ovi.Set(ovitemp)
 			case reflect.Float32:
-				v, err := this.GetFloat32s(confTag, def)
+				v, err := this.getFloat32s(confTag, def, lf)
 				if IsKeyNotFound(err) && omit {
 					break
 				}
 				if err != nil {
 					return err
 				}
-				ovi.Set(reflect.ValueOf(v))
+				ovi.Set(reflect.ValueOf(v).Convert(oti.Type))
 			case reflect.Float64:
-				v, err := this.GetFloat64s(confTag, def)
+				v, err := this.getFloat64s(confTag, def, lf)
 				if IsKeyNotFound(err) && omit {
 					break
 				}
 				if err != nil {
 					return err
 				}
-				ovi.Set(reflect.ValueOf(v))
+				ovi.Set(reflect.ValueOf(v).Convert(oti.Type))
 			case reflect.Struct:
 				if !this.hasChildBuffer(confTag) && omit {
 					break
 				}
-				ks := strings.Split(confTag, ".")
-				ttb, err := this.GetBuffer(ks)
-				if err != nil {
-					return NewBufferError(err, confTag)
+				src, berr := this.defaultSource(confTag, def)
+				if berr != nil {
+					return berr
+				}
+				ks, berr := lookupKey(confTag)
+				if berr != nil {
+					return berr
 				}
-				ttb.ChildrenLock.RLock()
-				defer ttb.ChildrenLock.RUnlock()
 				ovitemp := reflect.MakeSlice(oti.Type, 0, 0)
-				if tb, ok := ttb.Children[ks[len(ks)-1]]; ok {
-
-					tb.ChildrenLock.RLock()
-					defer tb.ChildrenLock.RUnlock()
+				if tb := src.view().find(ks); tb != nil {
 					var berr *BufferError
-					for i := 0; i < len(tb.Children); i++ {
-						if _, ok := tb.Children[fmt.Sprintf("%v", i)]; ok {
+					for i := 0; i < len(tb.children); i++ {
+						if _, ok := tb.children[strconv.Itoa(i)]; ok {
 							tempv := reflect.New(oti.Type.Elem())
-							berr = this.varSet(tempv.Type().Elem(), tempv.Elem(), fmt.Sprintf("%v.%v", confTag, i))
-							if err != nil {
+							berr = src.varSet(tempv.Type().Elem(), tempv.Elem(), fmt.Sprintf("%v.%v", confTag, i))
+							if berr != nil {
 								break
 							}
 							ovitemp = reflect.Append(ovitemp, tempv.Elem())
@@ -546,34 +913,32 @@ func (this *TreeBuffer) varSet(ot reflect.Type, ov reflect.Value, ptag string) *
 						return berr
 					}
 				} else {
-					return NewBufferError(err, confTag)
+					return NewBufferError(errKeyNotFound, confTag)
 				}
 				ovi.Set(ovitemp)
 			case reflect.Ptr:
 				if oti.Type.Elem().Elem().Kind() != reflect.Struct {
-					break
+					return NewBufferError(errType, confTag)
 				}
 				if !this.hasChildBuffer(confTag) && omit {
 					break
 				}
-				ks := strings.Split(confTag, ".")
-				ttb, err := this.GetBuffer(ks)
-				if err != nil {
-					return NewBufferError(err, confTag)
+				src, berr := this.defaultSource(confTag, def)
+				if berr != nil {
+					return berr
+				}
+				ks, berr := lookupKey(confTag)
+				if berr != nil {
+					return berr
 				}
-				ttb.ChildrenLock.RLock()
-				defer ttb.ChildrenLock.RUnlock()
 				ovitemp := reflect.MakeSlice(oti.Type, 0, 0)
-				if tb, ok := ttb.Children[ks[len(ks)-1]]; ok {
-
-					tb.ChildrenLock.RLock()
-					defer tb.ChildrenLock.RUnlock()
+				if tb := src.view().find(ks); tb != nil {
 					var berr *BufferError
-					for i := 0; i < len(tb.Children); i++ {
-						if _, ok := tb.Children[fmt.Sprintf("%v", i)]; ok {
+					for i := 0; i < len(tb.children); i++ {
+						if _, ok := tb.children[strconv.Itoa(i)]; ok {
 							tempv := reflect.New(oti.Type.Elem().Elem())
-							berr = this.varSet(tempv.Type().Elem(), tempv.Elem(), fmt.Sprintf("%v.%v", confTag, i))
-							if err != nil {
+							berr = src.varSet(tempv.Type().Elem(), tempv.Elem(), fmt.Sprintf("%v.%v", confTag, i))
+							if berr != nil {
 								break
 							}
 							ovitemp = reflect.Append(ovitemp, tempv)
@@ -586,9 +951,11 @@ func (this *TreeBuffer) varSet(ot reflect.Type, ov reflect.Value, ptag string) *
 						return berr
 					}
 				} else {
-					return NewBufferError(err, confTag)
+					return NewBufferError(errKeyNotFound, confTag)
 				}
 				ovi.Set(ovitemp)
+			default:
+				return NewBufferError(errType, confTag)
 			}
 		case reflect.Struct:
 			if !this.hasChildBuffer(confTag) && omit {
@@ -616,6 +983,8 @@ func (this *TreeBuffer) varSet(ot reflect.Type, ov reflect.Value, ptag string) *
 				if err != nil {
 					return err
 				}
+			} else {
+				return NewBufferError(errType, confTag)
 			}
 		case reflect.Map:
 			if oti.Type.Key().Kind() != reflect.String {
@@ -633,19 +1002,38 @@ func (this *TreeBuffer) varSet(ot reflect.Type, ov reflect.Value, ptag string) *
 					return err
 				}
 				for kt, vt := range v {
-					ovitemp.SetMapIndex(reflect.ValueOf(kt), reflect.ValueOf(vt))
+					ovitemp.SetMapIndex(reflect.ValueOf(kt), reflect.ValueOf(vt).Convert(oti.Type.Elem()))
+				}
+				ovi.Set(ovitemp)
+			case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+				reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+				reflect.Float32, reflect.Float64:
+				ovitemp := reflect.MakeMap(oti.Type)
+				v, err := this.GetMap(confTag, def)
+				if err != nil {
+					return err
+				}
+				for kt, vt := range v {
+					ev, err := this.convertValue(oti.Type.Elem(), confTag+"."+JoinKey(kt), vt)
+					if err != nil {
+						return err
+					}
+					ovitemp.SetMapIndex(reflect.ValueOf(kt), ev)
 				}
 				ovi.Set(ovitemp)
 			case reflect.Struct:
 				ovitemp := reflect.MakeMap(oti.Type)
-				mv, err := this.GetMapChild(confTag)
+				src, err := this.defaultSource(confTag, def)
+				if err != nil {
+					return err
+				}
+				mv, err := src.GetMapChild(confTag)
 				if err != nil {
 					return err
 				}
 				for kt, vt := range mv {
 					vtemp := reflect.New(oti.Type.Elem())
-					er := vt.Var(vtemp.Interface())
-					if err != nil {
+					if er := this.varChild(vt, confTag+"."+JoinKey(kt), vtemp.Interface()); er != nil {
 						return NewBufferError(er, confTag+"."+kt)
 					}
 					ovitemp.SetMapIndex(reflect.ValueOf(kt), vtemp.Elem())
@@ -653,75 +1041,130 @@ func (this *TreeBuffer) varSet(ot reflect.Type, ov reflect.Value, ptag string) *
 				ovi.Set(ovitemp)
 			case reflect.Ptr:
 				if oti.Type.Elem().Elem().Kind() != reflect.Struct {
-					break
+					return NewBufferError(errType, confTag)
 				}
 				ovitemp := reflect.MakeMap(oti.Type)
-				mv, err := this.GetMapChild(confTag)
+				src, err := this.defaultSource(confTag, def)
+				if err != nil {
+					return err
+				}
+				mv, err := src.GetMapChild(confTag)
 				if err != nil {
 					return err
 				}
 				for kt, vt := range mv {
 					vtemp := reflect.New(oti.Type.Elem().Elem())
-					er := vt.Var(vtemp.Interface())
-					if err != nil {
+					if er := this.varChild(vt, confTag+"."+JoinKey(kt), vtemp.Interface()); er != nil {
 						return NewBufferError(er, confTag+"."+kt)
 					}
 					ovitemp.SetMapIndex(reflect.ValueOf(kt), vtemp)
 				}
 				ovi.Set(ovitemp)
+			default:
+				return NewBufferError(errType, confTag)
 			} // end switch oti.Type.Elem().Kind()
+		default:
+			return NewBufferError(errType, confTag)
 		}
 	}
 	return nil
 }
 
-func (b *TreeBuffer) MergeFrom(b2 *TreeBuffer, cover bool) {
-	b.DataLock.Lock()
-	b2.DataLock.RLock()
-	for k, v := range b2.Data {
-		if _, ok := b.Data[k]; !ok || cover {
-			b.Data[k] = v
+// value of type t of the map value s of key
+func (this *TreeBuffer) convertValue(t reflect.Type, key, s string) (reflect.Value, *BufferError) {
+	v := reflect.New(t).Elem()
+	switch t.Kind() {
+	case reflect.Bool:
+		v.SetBool(this.convertBool(s))
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var n int64
+		var err error
+		if t == durationType {
+			var d time.Duration
+			d, err = time.ParseDuration(s)
+			n = int64(d)
+		} else {
+			n, err = strconv.ParseInt(s, 10, 64)
+		}
+		if err != nil || v.OverflowInt(n) {
+			return v, this.typeError(key, s)
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, 64)
+		if err != nil || v.OverflowUint(n) {
+			return v, this.typeError(key, s)
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil || v.OverflowFloat(f) {
+			return v, this.typeError(key, s)
 		}
+		v.SetFloat(f)
+	default:
+		return v, NewBufferError(errType, key)
 	}
-	b2.DataLock.RUnlock()
-	b.DataLock.Unlock()
+	return v, nil
+}
 
-	b.ChildrenLock.Lock()
-	b2.ChildrenLock.RLock()
-	for k, b2i := range b2.Children {
-		if bi, ok := b.Children[k]; !ok {
-			b.Children[k] = b2i
-		} else {
-			bi.MergeFrom(b2i, cover)
-		}
+// Var of the snapshot c of the child key, secret tags of the element
+// are marked on this with the key
+func (this *TreeBuffer) varChild(c *TreeBuffer, key string, o interface{}) error {
+	err := c.Var(o)
+	for k := range c.view().secrets {
+		this.MarkSecret(key + "." + k)
 	}
-	b2.ChildrenLock.RUnlock()
-	b.ChildrenLock.Unlock()
+	return err
 }
 
+// merge the values of b2, existing values are replaced if cover is set.
+// subtrees of b2 are shared as snapshots, later changes of either buffer
+// don't change the other
+func (b *TreeBuffer) MergeFrom(b2 *TreeBuffer, cover bool) {
+	src := b2.view()
+	b.write(func(root *node) {
+		root.merge(src, cover, b.epoch)
+		for k := range src.secrets {
+			if root.secrets == nil {
+				root.secrets = make(map[string]bool)
+			}
+			root.secrets[k] = true
+		}
+	})
+}
+
+// call fn with the key segments and value of every leaf
+func (b *TreeBuffer) each(ks []string, fn func(ks []string, value string)) {
+	b.view().each(ks, fn)
+}
+
+// string of all values with the keys printed under pre, secret values
+// are masked
 func (b *TreeBuffer) StringRecursive(pre string) string {
+	return b.stringRecursive(b.view(), pre, "")
+}
+
+// values of n whose path in b is rel, pre is only printed
+func (b *TreeBuffer) stringRecursive(n *node, pre, rel string) string {
 	str := ""
-	b.DataLock.RLock()
-	defer b.DataLock.RUnlock()
-	b.ChildrenLock.RLock()
-	defer b.ChildrenLock.RUnlock()
-	for k, v := range b.Data {
-		if len(pre) > 0 {
-			str += fmt.Sprintf("%-10s = %v\n", pre+"."+k, v)
-		} else {
-			str += fmt.Sprintf("%-10s = %v\n", k, v)
-		}
+	for k, v := range n.data {
+		k = joinPath(rel, JoinKey(n.dataName(k)))
+		str += fmt.Sprintf("%-10s = %v\n", joinPath(pre, k), b.maskValue(k, v))
 	}
-	for k, v := range b.Children {
-		if len(pre) > 0 {
-			str += fmt.Sprintf("%v", v.StringRecursive(pre+"."+k))
-		} else {
-			str += fmt.Sprintf("%v", v.StringRecursive(k))
-		}
+	for k, c := range n.children {
+		str += b.stringRecursive(c, pre, joinPath(rel, JoinKey(n.childName(k))))
 	}
 	return str
 }
 
+func joinPath(pre, k string) string {
+	if len(pre) > 0 {
+		return pre + "." + k
+	}
+	return k
+}
+
 func (b *TreeBuffer) String() string {
 	return b.StringRecursive("")
 }
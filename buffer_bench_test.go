@@ -0,0 +1,178 @@
+package configuration
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// rewrite of the locking of the buffer before snapshots, every level
+// guarded by read write locks. it isn't the old code, only its locks
+// and lookups, the *LockedRewrite benchmarks compare against it
+type lockedBuffer struct {
+	data         map[string]string
+	children     map[string]*lockedBuffer
+	dataLock     sync.RWMutex
+	childrenLock sync.RWMutex
+}
+
+func newLockedBuffer() *lockedBuffer {
+	return &lockedBuffer{
+		data:     make(map[string]string),
+		children: make(map[string]*lockedBuffer),
+	}
+}
+
+func (t *lockedBuffer) SetIn(ks []string, value string) {
+	if len(ks) == 1 {
+		t.dataLock.Lock()
+		defer t.dataLock.Unlock()
+		t.data[strings.ToLower(ks[0])] = value
+	} else if len(ks) > 1 {
+		t.childrenLock.Lock()
+		defer t.childrenLock.Unlock()
+		k := strings.ToLower(ks[0])
+		tb, ok := t.children[k]
+		if !ok {
+			tb = newLockedBuffer()
+			t.children[k] = tb
+		}
+		tb.SetIn(ks[1:], value)
+	}
+}
+
+func (t *lockedBuffer) GetIn(ks []string) (string, error) {
+	if len(ks) == 1 {
+		t.dataLock.RLock()
+		defer t.dataLock.RUnlock()
+		if s, ok := t.data[strings.ToLower(ks[0])]; ok {
+			return resolveValue(s)
+		}
+		return "", errKeyNotFound
+	} else if len(ks) > 1 {
+		t.childrenLock.RLock()
+		defer t.childrenLock.RUnlock()
+		if tb, ok := t.children[strings.ToLower(ks[0])]; ok {
+			return tb.GetIn(ks[1:])
+		}
+		return "", errKeyNotFound
+	}
+	return "", errKeyNotFound
+}
+
+func (t *lockedBuffer) GetString(key, def string) (string, *BufferError) {
+	ks, berr := lookupKey(key)
+	if berr != nil {
+		return "", berr
+	}
+	s, err := t.GetIn(ks)
+	if err != nil {
+		if err == errKeyNotFound && len(def) > 0 {
+			return def, nil
+		}
+		return "", NewBufferError(err, key)
+	}
+	return s, nil
+}
+
+type benchBuffer interface {
+	SetIn(ks []string, value string)
+	GetString(key, def string) (string, *BufferError)
+}
+
+const benchKey = "app.db.primary.host"
+
+func fillBench(b benchBuffer) {
+	for i := 0; i < 100; i++ {
+		s := strconv.Itoa(i)
+		b.SetIn([]string{"app", "svc" + s, "host"}, "host"+s)
+		b.SetIn([]string{"app", "svc" + s, "port"}, s)
+	}
+	b.SetIn(strings.Split(benchKey, "."), "localhost")
+}
+
+func benchGet(b *testing.B, tb benchBuffer) {
+	fillBench(tb)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := tb.GetString(benchKey, ""); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchGetParallel(b *testing.B, tb benchBuffer) {
+	fillBench(tb)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := tb.GetString(benchKey, ""); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// parallel reads while the buffer is changed, like a reload
+func benchGetParallelWrite(b *testing.B, tb benchBuffer) {
+	fillBench(tb)
+	done := make(chan struct{})
+	go func() {
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+				tb.SetIn([]string{"app", "svc" + strconv.Itoa(i%100), "port"}, strconv.Itoa(i))
+			}
+		}
+	}()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := tb.GetString(benchKey, ""); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.StopTimer()
+	close(done)
+}
+
+func BenchmarkGetString(b *testing.B)              { benchGet(b, NewTreeBuffer()) }
+func BenchmarkGetStringLockedRewrite(b *testing.B) { benchGet(b, newLockedBuffer()) }
+
+func BenchmarkGetStringParallel(b *testing.B) {
+	benchGetParallel(b, NewTreeBuffer())
+}
+
+func BenchmarkGetStringParallelLockedRewrite(b *testing.B) {
+	benchGetParallel(b, newLockedBuffer())
+}
+
+func BenchmarkGetStringParallelWrite(b *testing.B) {
+	benchGetParallelWrite(b, NewTreeBuffer())
+}
+
+func BenchmarkGetStringParallelWriteLockedRewrite(b *testing.B) {
+	benchGetParallelWrite(b, newLockedBuffer())
+}
+
+func BenchmarkVar(b *testing.B) {
+	tb := NewTreeBuffer()
+	fillBench(tb)
+	var cfg struct {
+		Host string `conf:"app.db.primary.host"`
+		Port int    `conf:"app.svc1.port"`
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			c := cfg
+			if err := tb.Var(&c); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,195 @@
+package configuration
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var errCacheChecksum = errors.New("configuration cache checksum mismatch")
+
+// state of a cached provider
+type CacheStatus struct {
+	// the buffer is the last known good one from the cache file
+	Stale bool
+	// when the used buffer was saved to the cache file
+	SavedAt time.Time
+	// the provider's error while stale
+	Err error
+	// the error saving the last load to the cache file, the loaded
+	// buffer is used anyway
+	SaveErr error
+}
+
+// wrap a provider, every successful load is saved to the cache file and
+// the cache is used if the provider fails, eg. a remote store is down.
+// the cache holds the provider's own values in clear, it's written with
+// mode 0600. the process environment isn't cached, it's merged again
+// when the cache is used
+type CachedProvider struct {
+	Provider Provider
+	file     string
+
+	status CacheStatus
+	buffer *TreeBuffer
+	lock   sync.RWMutex
+}
+
+type cacheValue struct {
+	Key    []string `json:"key"`
+	Value  string   `json:"value"`
+	Quoted string   `json:"quoted,omitempty"`
+}
+
+type cacheFile struct {
+	SavedAt time.Time    `json:"saved_at"`
+	Values  []cacheValue `json:"values"`
+}
+
+func NewCachedProvider(p Provider, file string) *CachedProvider {
+	return &CachedProvider{Provider: p, file: file}
+}
+
+func (c *CachedProvider) GetBuffer() (*TreeBuffer, error) {
+	c.lock.RLock()
+	buffer := c.buffer
+	c.lock.RUnlock()
+	if buffer != nil {
+		return buffer, nil
+	}
+	b, err := c.Provider.GetBuffer()
+	if err != nil {
+		return c.fallback(err)
+	}
+	return c.loaded(b)
+}
+
+func (c *CachedProvider) Reload() (*TreeBuffer, error) {
+	r, ok := c.Provider.(Reloader)
+	if !ok {
+		return nil, ErrNotReloadable
+	}
+	b, err := r.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return c.loaded(b)
+}
+
+func (c *CachedProvider) WaitChange(stop <-chan struct{}) (bool, error) {
+	w, ok := c.Provider.(Watcher)
+	if !ok {
+		return false, ErrNotWatchable
+	}
+	return w.WaitChange(stop)
+}
+
+func (c *CachedProvider) Status() CacheStatus {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.status
+}
+
+func (c *CachedProvider) loaded(b *TreeBuffer) (*TreeBuffer, error) {
+	now := time.Now()
+	status := CacheStatus{SavedAt: now}
+	if err := saveCache(c.file, b, now); err != nil {
+		status = CacheStatus{SaveErr: err}
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.buffer = b
+	c.status = status
+	return b, nil
+}
+
+func (c *CachedProvider) fallback(err error) (*TreeBuffer, error) {
+	b, savedAt, cerr := loadCache(c.file)
+	if cerr != nil {
+		return nil, fmt.Errorf("%v, cache: %v", err, cerr)
+	}
+	envBuffer, _ := NewEnvProvider().GetBuffer()
+	b.MergeFrom(envBuffer, false)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.buffer = b
+	c.status = CacheStatus{Stale: true, SavedAt: savedAt, Err: err}
+	return b, nil
+}
+
+// the file is a sha256 checksum line followed by the json values,
+// written to a temporary file and renamed into place
+func saveCache(file string, b *TreeBuffer, savedAt time.Time) error {
+	cf := cacheFile{SavedAt: savedAt, Values: cacheValues(b.view(), nil, nil)}
+	data, err := json.Marshal(cf)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	tmp, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err = tmp.Chmod(0600); err == nil {
+		_, err = fmt.Fprintf(tmp, "%s\n%s", hex.EncodeToString(sum[:]), data)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// values of n to cache, values of the process environment are left out
+func cacheValues(n *node, ks []string, values []cacheValue) []cacheValue {
+	for k, v := range n.data {
+		if chain := n.origins[k]; len(chain) > 0 && chain[len(chain)-1].Provider == "env" {
+			continue
+		}
+		values = append(values, cacheValue{append(ks[:len(ks):len(ks)], n.dataName(k)), v, n.quoted[k]})
+	}
+	for k, c := range n.children {
+		values = cacheValues(c, append(ks[:len(ks):len(ks)], n.childName(k)), values)
+	}
+	return values
+}
+
+func loadCache(file string) (*TreeBuffer, time.Time, error) {
+	bts, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	i := bytes.IndexByte(bts, '\n')
+	if i < 0 {
+		return nil, time.Time{}, errCacheChecksum
+	}
+	sum := sha256.Sum256(bts[i+1:])
+	if hex.EncodeToString(sum[:]) != string(bts[:i]) {
+		return nil, time.Time{}, errCacheChecksum
+	}
+	var cf cacheFile
+	if err = json.Unmarshal(bts[i+1:], &cf); err != nil {
+		return nil, time.Time{}, err
+	}
+	b := NewTreeBuffer()
+	b.SetOrigin(Origin{Provider: "cache", Source: file})
+	defer b.SetOrigin(Origin{})
+	for _, v := range cf.Values {
+		b.setIn(v.Key, v.Value, v.Quoted)
+	}
+	return b, cf.SavedAt, nil
+}
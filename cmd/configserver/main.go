@@ -0,0 +1,38 @@
+// Command configserver serves a configuration provider over HTTP,
+// see package configserver for the endpoints.
+//
+//	configserver -addr :8080 -provider consul::http://127.0.0.1:8500/app
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"os"
+
+	"gogs.xlh/tools/configuration"
+	"gogs.xlh/tools/configuration/configserver"
+)
+
+func main() {
+	provider := os.Getenv("GLOBAL_CONF")
+	if len(provider) == 0 {
+		provider = configuration.DefaultProvider
+	}
+	addr := flag.String("addr", ":8080", "listen address")
+	flag.StringVar(&provider, "provider", provider, "configuration provider, defaults to env GLOBAL_CONF")
+	redact := flag.Bool("redact", true, "mask secret values, -redact=false serves them in clear")
+	flag.Parse()
+
+	s, err := configserver.New(provider)
+	if err != nil {
+		log.Fatal(err)
+	}
+	s.Redact = *redact
+	s.OnWatchError(func(err error) {
+		log.Println("watch provider:", err)
+	})
+	go s.Watch(nil)
+	log.Printf("serving %s on %s", provider, *addr)
+	log.Fatal(http.ListenAndServe(*addr, s))
+}
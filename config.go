@@ -3,12 +3,18 @@ package configuration
 import (
 	"errors"
 	"os"
+	"time"
 )
 
 var (
 	ErrUnkownProvider = errors.New("unkown configuration type")
+	ErrNotReloadable  = errors.New("configuration provider can't reload")
+	ErrNotWatchable   = errors.New("configuration provider can't watch")
 )
 
+// type of the built-in providers.
+//
+// Deprecated: providers are registered by scheme, use Driver.Scheme
 type ConfigType int
 
 const (
@@ -22,6 +28,13 @@ const (
 	CTUnkown = -1
 )
 
+// config type of the built-in schemes, see Driver.Type
+var confTypeM = map[string]ConfigType{
+	"file": CTFileConf,
+	//"etcd": CTEtcd,
+	"env": CTEnv,
+}
+
 // parse config , must call before use config
 func Parse(pro ...string) {
 	var provider string
@@ -33,7 +46,7 @@ func Parse(pro ...string) {
 	} else {
 		provider = pro[0]
 	}
-	driver = &Driver{}
+	driver = &Driver{CacheFile: os.Getenv("GLOBAL_CONF_CACHE")}
 	err := driver.ParseProvider(provider)
 	if err != nil {
 		panic(err)
@@ -52,123 +65,72 @@ func loadDriver() {
 
 // get config value of type string
 func String(key string) (string, error) {
-	loadDriver()
-	v, e := driver.Buffer().GetString(key, "")
-	if e != nil {
-		return "", errors.New(e.Error())
-	} else {
-		return v, nil
-	}
+	return Get[string](key)
 }
 
-// get config value of type string
+// get config value of type bool
 func Bool(key string) (bool, error) {
-	loadDriver()
-	v, e := driver.Buffer().GetBool(key, "")
-	if e != nil {
-		return false, errors.New(e.Error())
-	} else {
-		return v, nil
-	}
+	return Get[bool](key)
 }
 
 // get config value of type int
 func Int(key string) (int, error) {
-	loadDriver()
-	i, e := driver.Buffer().GetInt(key, "")
-	if e != nil {
-		return 0, errors.New(e.Error())
-	} else {
-		return i, nil
-	}
+	return Get[int](key)
+}
+
+// get config value of type int64
+func Int64(key string) (int64, error) {
+	return Get[int64](key)
+}
+
+// get config value of type uint
+func Uint(key string) (uint, error) {
+	return Get[uint](key)
 }
 
 // get config value of type float32
 func Float32(key string) (float32, error) {
-	loadDriver()
-	v, e := driver.Buffer().GetFloat32(key, "")
-	if e != nil {
-		return 0, errors.New(e.Error())
-	} else {
-		return v, nil
-	}
+	return Get[float32](key)
 }
 
 // get config value of type float64
 func Float64(key string) (float64, error) {
-	loadDriver()
-	v, e := driver.Buffer().GetFloat64(key, "")
-	if e != nil {
-		return 0, errors.New(e.Error())
-	} else {
-		return v, nil
-	}
+	return Get[float64](key)
+}
+
+// get config value of type time.Duration, eg. 1m30s
+func Duration(key string) (time.Duration, error) {
+	return Get[time.Duration](key)
 }
 
 // get config values of type string slice
 func Strings(key string) ([]string, error) {
-	loadDriver()
-	v, e := driver.Buffer().GetStrings(key, "")
-	if e != nil {
-		return []string{}, errors.New(e.Error())
-	} else {
-		return v, nil
-	}
+	return Get[[]string](key)
 }
 
 // get config value of type bool slice
 func Bools(key string) ([]bool, error) {
-	loadDriver()
-	v, e := driver.Buffer().GetBools(key, "")
-	if e != nil {
-		return []bool{}, errors.New(e.Error())
-	} else {
-		return v, nil
-	}
+	return Get[[]bool](key)
 }
 
 // get config values of type int slice
 func Ints(key string) ([]int, error) {
-	loadDriver()
-	v, e := driver.Buffer().GetInts(key, "")
-	if e != nil {
-		return []int{}, errors.New(e.Error())
-	} else {
-		return v, nil
-	}
+	return Get[[]int](key)
 }
 
-// get config values of type int slice
+// get config values of type int64 slice
 func Int64s(key string) ([]int64, error) {
-	loadDriver()
-	v, e := driver.Buffer().GetInt64s(key, "")
-	if e != nil {
-		return []int64{}, errors.New(e.Error())
-	} else {
-		return v, nil
-	}
+	return Get[[]int64](key)
 }
 
 // get config values of type float32 slice
 func Float32s(key string) ([]float32, error) {
-	loadDriver()
-	v, e := driver.Buffer().GetFloat32s(key, "")
-	if e != nil {
-		return []float32{}, errors.New(e.Error())
-	} else {
-		return v, nil
-	}
+	return Get[[]float32](key)
 }
 
 // get config values of type float64 slice
 func Float64s(key string) ([]float64, error) {
-	loadDriver()
-	v, e := driver.Buffer().GetFloat64s(key, "")
-	if e != nil {
-		return []float64{}, errors.New(e.Error())
-	} else {
-		return v, nil
-	}
+	return Get[[]float64](key)
 }
 
 // get config value of custom struct type
@@ -177,3 +139,87 @@ func Var(o interface{}) error {
 	loadDriver()
 	return driver.Buffer().Var(o)
 }
+
+// get config values under prefix into o, see TreeBuffer.VarAt
+func VarAt(prefix string, o interface{}) error {
+	loadDriver()
+	return driver.Buffer().VarAt(prefix, o)
+}
+
+// view of the config under prefix, see TreeBuffer.Sub. the view
+// doesn't follow reloads, take a new one in OnChange
+func Sub(prefix string) *TreeBuffer {
+	loadDriver()
+	return driver.Buffer().Sub(prefix)
+}
+
+// whether key has a value or children
+func Has(key string) bool {
+	loadDriver()
+	return driver.Buffer().Has(key)
+}
+
+// whether key has a value
+func IsSet(key string) bool {
+	loadDriver()
+	return driver.Buffer().IsSet(key)
+}
+
+// sorted keys of all config values under prefix
+func Keys(prefix string) []string {
+	loadDriver()
+	return driver.Buffer().Keys(prefix)
+}
+
+// all config values as nested maps and slices, see TreeBuffer.AllSettings
+func AllSettings() map[string]interface{} {
+	loadDriver()
+	return driver.Buffer().AllSettings()
+}
+
+// origins of the config value of key, see TreeBuffer.Explain
+func Explain(key string) []Origin {
+	loadDriver()
+	return driver.Buffer().Explain(key)
+}
+
+// state of the last known good cache, false if GLOBAL_CONF_CACHE isn't set
+func CacheState() (CacheStatus, bool) {
+	loadDriver()
+	c, ok := driver.Provider.(*CachedProvider)
+	if !ok {
+		return CacheStatus{}, false
+	}
+	return c.Status(), true
+}
+
+// set the list format of the config, see TreeBuffer.SetListFormat
+func SetListFormat(f ListFormat) {
+	loadDriver()
+	driver.SetListFormat(f)
+}
+
+// reload config if the provider supports reloading
+func Reload() error {
+	loadDriver()
+	return driver.Reload()
+}
+
+// reload config every time the provider's source changes, block until
+// stop is closed. errors are retried, see OnWatchError
+func Watch(stop <-chan struct{}) error {
+	loadDriver()
+	return driver.Watch(stop)
+}
+
+// call fn with every failed wait or reload of Watch
+func OnWatchError(fn func(err error)) {
+	loadDriver()
+	driver.OnWatchError(fn)
+}
+
+// call fn with the old and new buffer after every reload
+func OnChange(fn func(old, new *TreeBuffer)) {
+	loadDriver()
+	driver.OnChange(fn)
+}
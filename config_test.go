@@ -1,9 +1,17 @@
 package configuration
 
 import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func init() {
@@ -49,7 +57,7 @@ type MapStruct struct {
 func TestString(t *testing.T) {
 	if v, err := Int("test.int"); err != nil || v != 1020 {
 		if err != nil {
-			t.Fatalf("err:", err.Error())
+			t.Fatal("err:", err.Error())
 		}
 		if v != 1020 {
 			t.Fatalf("value err")
@@ -141,7 +149,1434 @@ func TestString(t *testing.T) {
 		}
 	}
 	if cfg.StringDefValue != "defaultvalue" {
-		t.Fatalf("default string value error", cfg.StringDefValue)
+		t.Fatal("default string value error", cfg.StringDefValue)
 	}
 	return
 }
+
+type FileRefConfig struct {
+	Password string `conf:"db.password"`
+}
+
+func TestFileReference(t *testing.T) {
+	dir, err := ioutil.TempDir("", "configuration")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	secret := filepath.Join(dir, "db_password")
+	if err := ioutil.WriteFile(secret, []byte("s3cr3t\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	b := NewTreeBuffer()
+	b.Set("db.password", "@file:"+secret)
+	if v, err := b.GetString("db.password", ""); err != nil || v != "s3cr3t" {
+		t.Fatal("file reference value error", v, err)
+	}
+	cfg := FileRefConfig{}
+	if err := b.Var(&cfg); err != nil || cfg.Password != "s3cr3t" {
+		t.Fatal("file reference var error", cfg.Password, err)
+	}
+	b.Set("db.password", "@file:"+filepath.Join(dir, "missing"))
+	if _, err := b.GetString("db.password", ""); err == nil {
+		t.Fatal("missing referenced file should fail")
+	}
+
+	os.Setenv("CONF_TEST_TOKEN_FILE", secret)
+	defer os.Unsetenv("CONF_TEST_TOKEN_FILE")
+	eb, _ := NewEnvProvider().GetBuffer()
+	if v, err := eb.GetString("CONF_TEST_TOKEN", ""); err != nil || v != "s3cr3t" {
+		t.Fatal("env _FILE value error", v, err)
+	}
+
+	// references of remote stores and plain env variables are values
+	os.Setenv("CONF_TEST_REF", "@file:"+secret)
+	defer os.Unsetenv("CONF_TEST_REF")
+	eb, _ = NewEnvProvider().GetBuffer()
+	rb := NewTreeBuffer()
+	rb.SetOrigin(Origin{Provider: "consul", Source: "app/db/password"})
+	rb.Set("db.password", "@file:"+secret)
+	rb.MergeFrom(eb, false)
+	for _, key := range []string{"db.password", "CONF_TEST_REF"} {
+		if v, err := rb.GetString(key, ""); err != nil || v != "@file:"+secret {
+			t.Fatal("untrusted file reference resolved", key, v, err)
+		}
+	}
+	if m := rb.AllSettings()["db"].(map[string]interface{}); m["password"] != "@file:"+secret {
+		t.Fatal("untrusted file reference resolved", m)
+	}
+	rb.SetOrigin(Origin{})
+	rb.Set("db.password", "@file:"+secret)
+	if v, _ := rb.GetString("db.password", ""); v != "s3cr3t" {
+		t.Fatal("program set reference error", v)
+	}
+}
+
+type SecretConfig struct {
+	ApiKey string `conf:"wx.apikey,secret"`
+	Host   string `conf:"wx.host"`
+}
+
+func TestSecret(t *testing.T) {
+	b := NewTreeBuffer()
+	b.Set("db.password", "p4ss")
+	b.Set("wx.apikey", "k3y")
+	b.Set("wx.host", "localhost")
+	b.Set("wx.port", "p4ss")
+	cfg := SecretConfig{}
+	if err := b.Var(&cfg); err != nil || cfg.ApiKey != "k3y" {
+		t.Fatal("secret var error", cfg.ApiKey, err)
+	}
+	s := b.String()
+	if strings.Count(s, "p4ss") != 1 || strings.Contains(s, "k3y") {
+		t.Fatal("secret value printed", s)
+	}
+	if !strings.Contains(s, "localhost") {
+		t.Fatal("plain value masked", s)
+	}
+	if v, err := b.GetString("db.password", ""); err != nil || v != "p4ss" {
+		t.Fatal("secret value unreadable", v, err)
+	}
+	if _, err := b.GetInt("db.password", ""); err == nil || strings.Contains(err.Error(), "p4ss") {
+		t.Fatal("secret value in error", err)
+	}
+	if _, err := b.GetInt("wx.port", ""); err == nil || !strings.Contains(err.Error(), "p4ss") {
+		t.Fatal("plain value missing in error", err)
+	}
+	b.Set("db.apikey", "k3y")
+	b.MarkSecret("db.apikey")
+	if s := b.StringRecursive("app"); strings.Contains(s, "k3y") || !strings.Contains(s, "app.db.apikey") {
+		t.Fatal("secret value printed under a prefix", s)
+	}
+}
+
+type subSecretConfig struct {
+	Pw string `conf:"pw,secret"`
+}
+
+func TestSubSecret(t *testing.T) {
+	b := NewTreeBuffer()
+	b.Set("db.pw", "p4ss")
+	b.Set("db.inner.pw", "inn3r")
+	var cfg subSecretConfig
+	if err := b.Sub("db").Var(&cfg); err != nil || cfg.Pw != "p4ss" {
+		t.Fatal("sub secret var error", cfg.Pw, err)
+	}
+	if err := b.Sub("db").Sub("inner").Var(&cfg); err != nil || cfg.Pw != "inn3r" {
+		t.Fatal("nested sub secret var error", cfg.Pw, err)
+	}
+	if s := b.String(); strings.Contains(s, "p4ss") || strings.Contains(s, "inn3r") {
+		t.Fatal("secret of sub view printed by the parent", s)
+	}
+	if !b.IsSecret("db.pw") || !b.IsSecret("db.inner.pw") {
+		t.Fatal("secret of sub view not marked on the parent")
+	}
+}
+
+type mapElem struct {
+	N  int    `conf:"n"`
+	Pw string `conf:"pw,secret"`
+}
+
+func TestMapStructElements(t *testing.T) {
+	b := NewTreeBuffer()
+	b.Set("m.x.n", "1")
+	b.Set("m.x.pw", "p4ss")
+	var cfg struct {
+		M  map[string]mapElem  `conf:"m"`
+		MP map[string]*mapElem `conf:"m"`
+	}
+	if err := b.Var(&cfg); err != nil || cfg.M["x"].N != 1 || cfg.MP["x"].Pw != "p4ss" {
+		t.Fatal("map struct error", cfg, err)
+	}
+	if s := b.String(); strings.Contains(s, "p4ss") || !b.IsSecret("m.x.pw") {
+		t.Fatal("secret of map element printed", s)
+	}
+	b.Set("m.x.n", "notanint")
+	var m struct {
+		M map[string]mapElem `conf:"m"`
+	}
+	if err := b.Var(&m); err == nil {
+		t.Fatal("map struct element error dropped", m)
+	}
+	var mp struct {
+		M map[string]*mapElem `conf:"m"`
+	}
+	if err := b.Var(&mp); err == nil {
+		t.Fatal("map struct pointer element error dropped")
+	}
+	if _, err := GetFrom[map[string]mapElem](b, "m"); err == nil {
+		t.Fatal("map struct element error dropped by GetFrom")
+	}
+}
+
+type staticProvider struct {
+	buffer *TreeBuffer
+}
+
+func (s *staticProvider) GetBuffer() (*TreeBuffer, error) {
+	return s.buffer, nil
+}
+
+func TestRegisterProvider(t *testing.T) {
+	RegisterProvider("static", func(param string) (Provider, error) {
+		b := NewTreeBuffer()
+		b.Set("static.param", param)
+		return &staticProvider{b}, nil
+	})
+	defer unregisterProvider("static")
+	d := &Driver{}
+	if err := d.ParseProvider("static::hello"); err != nil {
+		t.Fatal("parse registered provider error", err)
+	}
+	if d.Type != CTUnkown {
+		t.Fatal("registered provider type error", d.Type)
+	}
+	if _, err := d.LoadProvider(); err != nil {
+		t.Fatal("load registered provider error", err)
+	}
+	if v, err := d.Buffer().GetString("static.param", ""); err != nil || v != "hello" {
+		t.Fatal("registered provider value error", v, err)
+	}
+	if err := d.ParseProvider("nope::hello"); err == nil {
+		t.Fatal("unregistered provider should fail")
+	}
+}
+
+func TestConfd(t *testing.T) {
+	dir, err := ioutil.TempDir("", "configuration")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"00-defaults.ini": "wx.oracle.host = localhost\nwx.oracle.port = 1521\n",
+		"50-site.json":    `{"wx": {"oracle": {"port": 1522}}}`,
+		"90-local.ini":    "wx.oracle.host = 10.0.0.1\n",
+		".90-hidden.ini":  "wx.oracle.host = hidden\n",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, p := range []Provider{NewConfdProvider(dir), NewFileProvider(filepath.Join(dir, "*"))} {
+		b, err := p.GetBuffer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v, _ := b.GetString("wx.oracle.host", ""); v != "10.0.0.1" {
+			t.Fatal("conf.d override error", v)
+		}
+		if v, _ := b.GetInt("wx.oracle.port", ""); v != 1522 {
+			t.Fatal("conf.d override error", v)
+		}
+	}
+	b, err := NewFileProvider(filepath.Join(dir, "*.ini")).GetBuffer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := b.GetInt("wx.oracle.port", ""); v != 1521 {
+		t.Fatal("conf.d pattern error", v)
+	}
+	if b, err := NewFileProvider(filepath.Join(dir, "*.yaml")).GetBuffer(); err != nil || b.Has("wx") {
+		t.Fatal("conf.d without matches should be empty", err)
+	}
+	if _, err := NewConfdProvider(filepath.Join(dir, "missing")).GetBuffer(); err == nil {
+		t.Fatal("missing conf.d should fail")
+	}
+
+	// a list of a later file replaces the whole list
+	list := map[string]string{
+		"00-list.json": `{"hosts": ["a", "b", "c"], "servers": [{"name": "a"}, {"name": "b"}]}`,
+		"10-list.json": `{"hosts": ["d"], "servers": [{"name": "d"}]}`,
+	}
+	ldir := filepath.Join(dir, "list[1]")
+	if err := os.Mkdir(ldir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range list {
+		if err := ioutil.WriteFile(filepath.Join(ldir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b, err = NewConfdProvider(ldir).GetBuffer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := b.GetStrings("hosts", ""); len(v) != 1 || v[0] != "d" {
+		t.Fatal("conf.d list override error", v)
+	}
+	if b.Has("servers.1") {
+		t.Fatal("conf.d list elements left", b.Keys("servers"))
+	}
+	// [ of an existing name isn't a pattern
+	b, err = NewFileProvider(filepath.Join(ldir, "10-list.json")).GetBuffer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := b.GetString("hosts.0", ""); v != "d" {
+		t.Fatal("file name with [ error", v)
+	}
+}
+
+func TestDotenv(t *testing.T) {
+	dir, err := ioutil.TempDir("", "configuration")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	secret := filepath.Join(dir, "token")
+	ioutil.WriteFile(secret, []byte("t0k\n"), 0600)
+	env := filepath.Join(dir, ".env")
+	content := `# local settings
+DB_HOST=localhost # inline comment
+export DB_PORT=5432
+DB_NAME="app \"db\"\n"
+DB_PASS='p#ss\n'
+DB_CERT="line1
+line2"
+API_TOKEN_FILE=` + secret + `
+CONF_TEST_DOTENV=file
+CONF_TEST_DOTENV_EXPLICIT=file
+DB_QUOTED='"v"'
+`
+	if err := ioutil.WriteFile(env, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("CONF_TEST_DOTENV", "env")
+	defer os.Unsetenv("CONF_TEST_DOTENV")
+	os.Setenv("CONF_TEST_DOTENV_EXPLICIT_FILE", secret)
+	defer os.Unsetenv("CONF_TEST_DOTENV_EXPLICIT_FILE")
+	b, err := NewDotenvProvider(env).GetBuffer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := b.GetString("DB_QUOTED", ""); v != `"v"` {
+		t.Fatal("dotenv value unquoted twice", v)
+	}
+	expects := map[string]string{
+		"DB_HOST":          "localhost",
+		"DB_PORT":          "5432",
+		"DB_NAME":          "app \"db\"\n",
+		"DB_PASS":          `p#ss\n`,
+		"DB_CERT":          "line1\nline2",
+		"API_TOKEN":        "t0k",
+		"CONF_TEST_DOTENV": "env",
+		// an explicit value wins over a _FILE reference
+		"CONF_TEST_DOTENV_EXPLICIT": "file",
+	}
+	for k, e := range expects {
+		if v, err := b.GetString(k, ""); err != nil || v != e {
+			t.Fatalf("dotenv %v = %q, expect %q %v", k, v, e, err)
+		}
+	}
+	if _, err := parseDotenvPairs("A=\"open\n"); err == nil {
+		t.Fatal("unterminated quote should fail")
+	}
+}
+
+func TestProperties(t *testing.T) {
+	data := `# comment
+! another comment
+wx.oracle.host = 10.0.0.1
+wx.oracle.port:1521
+wx.oracle.user   scott
+wx.greeting = \u4f60\u597d \ud83d\ude00
+wx.key\:with\=seps = v
+wx.path = c:\\app\\conf
+wx.list = a;\
+          b;\
+          c
+wx.empty
+wx.quoted = "hi"
+wx.a[0]\\b = literal
+`
+	b := NewTreeBuffer()
+	if err := parseProperties(b, []byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	expects := map[string]string{
+		"wx.oracle.host":   "10.0.0.1",
+		"wx.oracle.port":   "1521",
+		"wx.oracle.user":   "scott",
+		"wx.greeting":      "你好 😀",
+		"wx.key:with=seps": "v",
+		"wx.path":          `c:\app\conf`,
+		"wx.list":          "a;b;c",
+		"wx.empty":         "",
+		"wx.quoted":        `"hi"`,
+	}
+	for k, e := range expects {
+		if v, err := b.GetString(k, "x"); err != nil || v != e {
+			t.Fatalf("properties %v = %q, expect %q %v", k, v, e, err)
+		}
+	}
+	if v, err := b.GetIn([]string{"wx", `a[0]\b`}); err != nil || v != "literal" {
+		t.Fatal("properties key reinterpreted", v, err)
+	}
+	if err := parseProperties(NewTreeBuffer(), []byte(`k = \u12`)); err == nil {
+		t.Fatal("malformed unicode escape should fail")
+	}
+}
+
+type HCLServer struct {
+	Port  int      `conf:"port"`
+	Hosts []string `conf:"hosts,omit"`
+}
+
+type HCLConfig struct {
+	Servers map[string]HCLServer `conf:"server"`
+	Name    string               `conf:"name"`
+}
+
+func TestHCL(t *testing.T) {
+	data := `# service config
+name = "api \"gateway\""
+debug = true // inline comment
+ratio = -1.5e3
+
+/* labeled blocks */
+server "api" {
+  port  = 80
+  hosts = ["a", "b",
+           "c"]
+}
+server "admin" { port = 8080 }
+
+listener {
+  addr = ":80"
+}
+listener {
+  addr = ":443"
+}
+
+database "primary" "cn-east" {
+  dsn = <<-EOT
+    user=app
+      host=db
+    EOT
+  opts = { timeout = "5s", "pool.size": 10 }
+}
+`
+	b := NewTreeBuffer()
+	if err := parseHCL(b, []byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	expects := map[string]string{
+		"name":                                  `api "gateway"`,
+		"debug":                                 "true",
+		"ratio":                                 "-1.5e3",
+		"server.api.port":                       "80",
+		"server.api.hosts.2":                    "c",
+		"server.admin.port":                     "8080",
+		"listener.1.addr":                       ":443",
+		"database.primary.cn-east.dsn":          "user=app\n  host=db\n",
+		"database.primary.cn-east.opts.timeout": "5s",
+	}
+	for k, e := range expects {
+		if v, err := b.GetString(k, ""); err != nil || v != e {
+			t.Fatalf("hcl %v = %q, expect %q %v", k, v, e, err)
+		}
+	}
+	cfg := HCLConfig{}
+	if err := b.Var(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Servers["api"].Port != 80 || len(cfg.Servers["api"].Hosts) != 3 || cfg.Servers["admin"].Port != 8080 {
+		t.Fatal("hcl var error", cfg)
+	}
+	for _, bad := range []string{"a = ", "a = var.x", "b {", "a = \"x", "a = [1 2]"} {
+		if err := parseHCL(NewTreeBuffer(), []byte(bad)); err == nil {
+			t.Fatalf("hcl %q should fail", bad)
+		}
+	}
+}
+
+type flakyProvider struct {
+	values map[string]string
+	err    error
+	// merge the process environment like the remote providers
+	env bool
+}
+
+func (f *flakyProvider) GetBuffer() (*TreeBuffer, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	b := NewTreeBuffer()
+	for k, v := range f.values {
+		b.Set(k, v)
+	}
+	if f.env {
+		envBuffer, _ := NewEnvProvider().GetBuffer()
+		b.MergeFrom(envBuffer, false)
+	}
+	return b, nil
+}
+
+func (f *flakyProvider) Reload() (*TreeBuffer, error) {
+	return f.GetBuffer()
+}
+
+// flakyProvider whose waits return the errors of waits, nil for a change
+type watchedProvider struct {
+	flakyProvider
+	waits chan error
+}
+
+func (w *watchedProvider) WaitChange(stop <-chan struct{}) (bool, error) {
+	select {
+	case err := <-w.waits:
+		return err == nil, err
+	case <-stop:
+		return false, nil
+	}
+}
+
+func TestWatchRetry(t *testing.T) {
+	defer func(min time.Duration) { watchRetryMin = min }(watchRetryMin)
+	watchRetryMin = time.Millisecond
+	p := &watchedProvider{flakyProvider{values: map[string]string{"w.v": "1"}}, make(chan error)}
+	d := &Driver{Provider: p}
+	errs := make(chan error, 2)
+	d.OnWatchError(func(err error) { errs <- err })
+	changed := make(chan string, 1)
+	d.OnChange(func(_, new *TreeBuffer) {
+		v, _ := new.GetString("w.v", "")
+		changed <- v
+	})
+	stop := make(chan struct{})
+	done := make(chan error, 1)
+	go func() { done <- d.Watch(stop) }()
+	p.waits <- errors.New("blip")
+	if err := <-errs; err.Error() != "blip" {
+		t.Fatal("watch error not reported", err)
+	}
+	p.values = map[string]string{"w.v": "2"}
+	p.waits <- nil
+	select {
+	case v := <-changed:
+		if v != "2" {
+			t.Fatal("watch reload error", v)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("watch stopped after an error")
+	}
+	close(stop)
+	if err := <-done; err != nil {
+		t.Fatal("watch error", err)
+	}
+}
+
+func TestCachedProvider(t *testing.T) {
+	dir, err := ioutil.TempDir("", "configuration")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "config.cache")
+	remote := &flakyProvider{values: map[string]string{"wx.oracle.host": "10.0.0.1", `redirects."/a.html"`: "/b.html"}}
+
+	c := NewCachedProvider(remote, file)
+	if _, err := c.GetBuffer(); err != nil {
+		t.Fatal(err)
+	}
+	if c.Status().Stale {
+		t.Fatal("fresh load reported stale")
+	}
+
+	remote.err = errors.New("remote down")
+	c = NewCachedProvider(remote, file)
+	b, err := c.GetBuffer()
+	if err != nil {
+		t.Fatal("cache fallback error", err)
+	}
+	if v, _ := b.GetString("wx.oracle.host", ""); v != "10.0.0.1" {
+		t.Fatal("cache value error", v)
+	}
+	if m, _ := b.GetMap("redirects", ""); m["/a.html"] != "/b.html" {
+		t.Fatal("cache quoted key error", m)
+	}
+	if st := c.Status(); !st.Stale || st.Err != remote.err || st.SavedAt.IsZero() {
+		t.Fatal("cache status error", st)
+	}
+
+	remote.err = nil
+	remote.values["wx.oracle.host"] = "10.0.0.2"
+	if b, err = c.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := b.GetString("wx.oracle.host", ""); v != "10.0.0.2" || c.Status().Stale {
+		t.Fatal("cache recover error", v, c.Status())
+	}
+
+	bts, _ := ioutil.ReadFile(file)
+	ioutil.WriteFile(file, bytes.Replace(bts, []byte("10.0.0.2"), []byte("10.0.0.9"), 1), 0600)
+	remote.err = errors.New("remote down")
+	if _, err := NewCachedProvider(remote, file).GetBuffer(); err == nil {
+		t.Fatal("corrupted cache accepted")
+	}
+
+	// the environment isn't cached but merged again on fallback
+	os.Setenv("CONF_TEST_CACHE_TOKEN", "t1")
+	defer os.Unsetenv("CONF_TEST_CACHE_TOKEN")
+	remote = &flakyProvider{values: map[string]string{"wx.oracle.host": "10.0.0.3"}, env: true}
+	if _, err := NewCachedProvider(remote, file).GetBuffer(); err != nil {
+		t.Fatal(err)
+	}
+	if bts, _ := ioutil.ReadFile(file); bytes.Contains(bts, []byte("CONF_TEST_CACHE_TOKEN")) {
+		t.Fatal("environment written to the cache")
+	}
+	os.Setenv("CONF_TEST_CACHE_TOKEN", "t2")
+	remote.err = errors.New("remote down")
+	b, err = NewCachedProvider(remote, file).GetBuffer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := b.GetString("CONF_TEST_CACHE_TOKEN", ""); v != "t2" {
+		t.Fatal("cache fallback environment error", v)
+	}
+	if v, _ := b.GetString("wx.oracle.host", ""); v != "10.0.0.3" {
+		t.Fatal("cache value error", v)
+	}
+
+	// an unwritable cache doesn't fail a good load
+	remote.err = nil
+	c = NewCachedProvider(remote, filepath.Join(dir, "missing", "config.cache"))
+	if _, err := c.GetBuffer(); err != nil {
+		t.Fatal("cache save error failed the load", err)
+	}
+	if st := c.Status(); st.SaveErr == nil || st.Stale {
+		t.Fatal("cache save error status", st)
+	}
+}
+
+func TestProfiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "configuration")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"config.ini": `wx.oracle.host = localhost
+wx.oracle.port = 1521
+wx.log.level = debug
+[profile:prod]
+wx.log.level = info
+[profile:cn-east]
+wx.oracle.port = 1522
+[other]
+wx.mp.appid = app
+`,
+		"config.prod.ini":    "wx.oracle.host = 10.0.0.1\n",
+		"config.cn-east.ini": "wx.oracle.host = 10.1.0.1\n",
+		"config.dev.ini":     "wx.debug = true\n",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	file := filepath.Join(dir, "config.ini")
+	cases := []struct {
+		profiles []string
+		expects  map[string]string
+	}{
+		{nil, map[string]string{"wx.oracle.host": "localhost", "wx.oracle.port": "1521", "wx.log.level": "debug", "wx.mp.appid": "app"}},
+		{[]string{"prod"}, map[string]string{"wx.oracle.host": "10.0.0.1", "wx.oracle.port": "1521", "wx.log.level": "info"}},
+		{[]string{"prod", "cn-east"}, map[string]string{"wx.oracle.host": "10.1.0.1", "wx.oracle.port": "1522", "wx.log.level": "info"}},
+	}
+	for _, c := range cases {
+		b, err := NewFileProvider(file).WithProfiles(c.profiles...).GetBuffer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, e := range c.expects {
+			if v, _ := b.GetString(k, ""); v != e {
+				t.Fatalf("profiles %v: %v = %q, expect %q", c.profiles, k, v, e)
+			}
+		}
+		if b.hasChildBuffer("profile:prod") {
+			t.Fatal("profile section left in buffer")
+		}
+	}
+
+	os.Setenv(profileEnv, "prod")
+	defer os.Unsetenv(profileEnv)
+	b, err := NewConfdProvider(dir).GetBuffer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := b.GetString("wx.oracle.host", ""); v != "10.0.0.1" {
+		t.Fatal("env profile error", v)
+	}
+	// only overlays of the active profiles are skipped
+	if !b.IsSet("wx.debug") {
+		t.Fatal("file named like the overlay of an inactive profile skipped")
+	}
+
+	// profiles of the provider param override env APP_PROFILE, without
+	// prod config.prod.ini is an ordinary file loaded after config.ini
+	for param, host := range map[string]string{
+		"file::" + file + "#profile=prod,cn-east": "10.1.0.1",
+		"confd::" + dir + "#profile=dev":          "10.0.0.1",
+		"confd::" + dir + "#profile=":             "10.0.0.1",
+	} {
+		d := &Driver{}
+		if err := d.ParseProvider(param); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := d.LoadProvider(); err != nil {
+			t.Fatal(err)
+		}
+		if v, _ := d.Buffer().GetString("wx.oracle.host", ""); v != host {
+			t.Fatal("param profile error", param, v)
+		}
+		if d.Buffer().IsSet("wx.debug") != strings.HasPrefix(param, "confd") {
+			t.Fatal("param profile overlay error", param)
+		}
+	}
+	d := &Driver{}
+	d.ParseProvider("file::" + file + "#other=1")
+	if _, err := d.LoadProvider(); err == nil {
+		t.Fatal("unknown file option should fail")
+	}
+
+	confd := filepath.Join(dir, "conf.d")
+	os.Mkdir(confd, 0755)
+	ioutil.WriteFile(filepath.Join(confd, "10-db.ini"), []byte("db.host = a\n"), 0644)
+	ioutil.WriteFile(filepath.Join(confd, "10-db.local.ini"), []byte("db.host = b\n"), 0644)
+	b, err = NewConfdProvider(confd).WithProfiles().GetBuffer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := b.GetString("db.host", ""); v != "b" {
+		t.Fatal("file named like an overlay skipped without profiles", v)
+	}
+}
+
+type CaseConfig struct {
+	Host      string            `conf:"WX.Oracle.HOST"`
+	Redirects map[string]string `conf:"wmds.wxoauth2.redirects"`
+	Def       string            `conf:"wx.none,default(MyValue)"`
+	Omit      string            `conf:"wx.none,OMIT"`
+}
+
+func TestCaseInsensitive(t *testing.T) {
+	b := NewTreeBuffer()
+	b.Set("Wx.Oracle.Host", "10.0.0.1")
+	b.Set(`wmds.wxoauth2.redirects."/Menu_UserCenter.html"`, "/UserCenter.html")
+	if v, err := b.GetString("wx.oracle.host", ""); err != nil || v != "10.0.0.1" {
+		t.Fatal("case insensitive lookup error", v, err)
+	}
+	if m, err := b.GetMap("WMDS.wxoauth2.Redirects", ""); err != nil || m["/Menu_UserCenter.html"] != "/UserCenter.html" {
+		t.Fatal("map key case error", m, err)
+	}
+	b.Set("WX.ORACLE.HOST", "10.0.0.2")
+	if v, _ := b.GetString("wx.oracle.host", ""); v != "10.0.0.2" {
+		t.Fatal("case insensitive set error", v)
+	}
+	if !strings.Contains(b.String(), "Wx.Oracle.HOST") {
+		t.Fatal("key names not kept", b.String())
+	}
+	cfg := CaseConfig{}
+	if err := b.Var(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Host != "10.0.0.2" || cfg.Redirects["/Menu_UserCenter.html"] != "/UserCenter.html" || cfg.Def != "MyValue" {
+		t.Fatal("case insensitive var error", cfg)
+	}
+
+	os.Setenv("CONF_TEST_CASE", "v")
+	defer os.Unsetenv("CONF_TEST_CASE")
+	eb, _ := NewEnvProvider().GetBuffer()
+	if v, err := eb.GetString("conf_test_case", ""); err != nil || v != "v" {
+		t.Fatal("env case insensitive error", v, err)
+	}
+}
+
+type KeyPathServer struct {
+	Host string `conf:"host"`
+}
+
+type KeyPathConfig struct {
+	First   string            `conf:"servers[0].host"`
+	Dotted  string            `conf:"wx.\"a.b\".c"`
+	Escaped string            `conf:"wx.d\\.e"`
+	Servers []KeyPathServer   `conf:"servers"`
+	Hosts   map[string]string `conf:"hosts"`
+}
+
+func TestKeyPath(t *testing.T) {
+	cases := map[string][]string{
+		`a.b.c`:                  {"a", "b", "c"},
+		`a."b.c".d`:              {"a", "b.c", "d"},
+		`a.b."c.d"`:              {"a", "b", "c.d"},
+		`servers[0].host`:        {"servers", "0", "host"},
+		`m[1][2]`:                {"m", "1", "2"},
+		`[0].a`:                  {"0", "a"},
+		`a\.b.c`:                 {"a.b", "c"},
+		`a."q\"uote".b`:          {"a", `q"uote`, "b"},
+		`a..b`:                   {"a", "", "b"},
+		`redirects."/menu.html"`: {"redirects", "/menu.html"},
+	}
+	for key, e := range cases {
+		ks, err := ParseKey(key)
+		if err != nil || strings.Join(ks, "|") != strings.Join(e, "|") {
+			t.Fatalf("ParseKey(%q) = %q, expect %q %v", key, ks, e, err)
+		}
+		if ks2, _ := ParseKey(JoinKey(ks...)); strings.Join(ks2, "|") != strings.Join(e, "|") {
+			t.Fatalf("JoinKey(%q) = %q doesn't round trip", ks, JoinKey(ks...))
+		}
+	}
+	for _, key := range []string{`a."b`, `a[0`, `a\`} {
+		if _, err := ParseKey(key); err == nil {
+			t.Fatalf("ParseKey(%q) should fail", key)
+		}
+	}
+
+	b := NewTreeBuffer()
+	b.Set("servers[0].host", "h0")
+	b.Set("servers.1.host", "h1")
+	b.Set(`wx."a.b".c`, "dotted")
+	b.Set(`wx.d\.e`, "escaped")
+	b.Set(`hosts."x.y"`, "xy")
+	if v, _ := b.GetString("servers.0.host", ""); v != "h0" {
+		t.Fatal("bracket index set error", v)
+	}
+	if v, _ := b.GetString(`wx."a.b".c`, ""); v != "dotted" {
+		t.Fatal("quoted segment error", v)
+	}
+	cfg := KeyPathConfig{}
+	if err := b.Var(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.First != "h0" || cfg.Dotted != "dotted" || cfg.Escaped != "escaped" || len(cfg.Servers) != 2 || cfg.Hosts["x.y"] != "xy" {
+		t.Fatal("key path var error", cfg)
+	}
+	if err := b.Delete(`wx."a.b".c`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.GetString(`wx."a.b".c`, ""); !IsKeyNotFound(err) {
+		t.Fatal("quoted segment delete error", err)
+	}
+	if _, err := b.GetString(`wx."a.b`, ""); err == nil || IsKeyNotFound(err) {
+		t.Fatal("malformed key should fail", err)
+	}
+}
+
+type ListConfig struct {
+	Hosts  []string  `conf:"list.hosts,sep(\",\"),trim"`
+	Quoted []string  `conf:"list.quoted"`
+	JSON   []int64   `conf:"list.json"`
+	Def    []string  `conf:"list.none,sep(\",\"),default(\"a,b\",c)"`
+	Floats []float64 `conf:"list.floats,sep(|)"`
+}
+
+func TestList(t *testing.T) {
+	b := NewTreeBuffer()
+	b.Set("list.hosts", " h1 , h2,h3 ")
+	b.Set("list.quoted", `"a;b";"say ""hi""";c`)
+	b.Set("list.json", `[1, 2, 3]`)
+	b.Set("list.floats", "1.5|2")
+	b.Set("list.strs", `["a;b", "c", null]`)
+	if ss, _ := b.GetStrings("list.strs", ""); len(ss) != 3 || ss[0] != "a;b" || ss[2] != "" {
+		t.Fatal("json list error", ss)
+	}
+	if ss, _ := b.GetStrings("list.quoted", ""); len(ss) != 3 || ss[0] != "a;b" || ss[1] != `say "hi"` {
+		t.Fatal("quoted list error", ss)
+	}
+	if ss, _ := b.GetStringsWith("list.hosts", "", ListFormat{Sep: ",", Trim: true}); len(ss) != 3 || ss[0] != "h1" {
+		t.Fatal("list format error", ss)
+	}
+	if ss, _ := b.GetStrings("list.none", `x;"y;z"`); len(ss) != 2 || ss[1] != "y;z" {
+		t.Fatal("list default error", ss)
+	}
+	// values whose quotes don't parse are split at the separator
+	b.Set("list.bad", `"a;b`)
+	if ss, err := b.GetStrings("list.bad", ""); err != nil || len(ss) != 2 || ss[0] != `"a` {
+		t.Fatal("unterminated quote error", ss, err)
+	}
+	// a single quoted element keeps its separator, scalars lose the quotes
+	b.Set("list.one", `"a;b"`)
+	if ss, _ := b.GetStrings("list.one", ""); len(ss) != 1 || ss[0] != "a;b" {
+		t.Fatal("single quoted element error", ss)
+	}
+	if v, _ := b.GetString("list.one", ""); v != "a;b" {
+		t.Fatal("quoted scalar error", v)
+	}
+	if ss, _ := b.Sub("list").Clone().GetStrings("one", ""); len(ss) != 1 {
+		t.Fatal("quoted element of a copy error", ss)
+	}
+	if err := parseINI(b, []byte(`list.ini = "c;d"`)); err != nil {
+		t.Fatal(err)
+	}
+	if ss, _ := b.GetStrings("list.ini", ""); len(ss) != 1 || ss[0] != "c;d" {
+		t.Fatal("single quoted ini element error", ss)
+	}
+	b.Set("list.text", `"quoted" text;x`)
+	if ss, _ := b.GetStrings("list.text", ""); len(ss) != 2 || ss[0] != `"quoted" text` {
+		t.Fatal("quoted text error", ss)
+	}
+	cfg := ListConfig{}
+	if err := b.Var(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Hosts) != 3 || cfg.Hosts[2] != "h3" || len(cfg.Quoted) != 3 || len(cfg.JSON) != 3 || cfg.JSON[2] != 3 ||
+		len(cfg.Def) != 2 || cfg.Def[0] != "a,b" || len(cfg.Floats) != 2 || cfg.Floats[0] != 1.5 {
+		t.Fatal("list var error", cfg)
+	}
+
+	c := b.Clone()
+	b.SetListFormat(ListFormat{Sep: ",", Trim: true})
+	if is, _ := b.GetInt64s("list.hosts2", "1, 2"); len(is) != 2 || is[1] != 2 {
+		t.Fatal("buffer list format error", is)
+	}
+	if ss, _ := b.Sub("list").GetStrings("hosts", ""); len(ss) != 3 || ss[0] != "h1" {
+		t.Fatal("sub list format error", ss)
+	}
+	if ss, _ := c.GetStrings("list.hosts", ""); len(ss) != 1 {
+		t.Fatal("list format changed other buffers", ss)
+	}
+}
+
+type TagItem struct {
+	Name string `conf:"name"`
+	Port int    `conf:"port,default(80)"`
+}
+
+type TagConfig struct {
+	Case    string            `conf:"tag.case,default(MyValue)"`
+	Quoted  string            `conf:"tag.quoted,default(\"a,b)\")"`
+	Escaped string            `conf:"tag.escaped,default(x\\,y\\))"`
+	Empty   string            `conf:"tag.empty,default()"`
+	Count   int               `conf:"tag.count,default()"`
+	List    []string          `conf:"tag.list,default([\"a,b\", \"c)\"])"`
+	Map     map[string]string `conf:"tag.map,default({\"Key\": \"v\", \"n\": 1})"`
+	Items   []TagItem         `conf:"tag.items,default([{\"name\": \"a\"}, {\"name\": \"b\", \"port\": 81}])"`
+}
+
+func TestTag(t *testing.T) {
+	b := NewTreeBuffer()
+	b.Set("tag.other", "x")
+	cfg := TagConfig{Empty: "preset"}
+	if err := b.Var(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Case != "MyValue" || cfg.Quoted != "a,b)" || cfg.Escaped != "x,y)" || cfg.Empty != "" || cfg.Count != 0 {
+		t.Fatal("tag default error", cfg)
+	}
+	if len(cfg.List) != 2 || cfg.List[0] != "a,b" || cfg.List[1] != "c)" {
+		t.Fatal("json list default error", cfg.List)
+	}
+	if cfg.Map["Key"] != "v" || cfg.Map["n"] != "1" {
+		t.Fatal("json map default error", cfg.Map)
+	}
+	if len(cfg.Items) != 2 || cfg.Items[0].Port != 80 || cfg.Items[1].Name != "b" || cfg.Items[1].Port != 81 {
+		t.Fatal("json struct slice default error", cfg.Items)
+	}
+	bad := struct {
+		V string `conf:"tag.v,default(a"`
+	}{}
+	if err := b.Var(&bad); err == nil {
+		t.Fatal("malformed tag should fail")
+	}
+}
+
+func TestGet(t *testing.T) {
+	if v, err := Get[int64]("test.int"); err != nil || v != 1020 {
+		t.Fatal("get int64 error", err, v)
+	}
+	if v, err := GetOr[string]("test.none", "fallback"); err != nil || v != "fallback" {
+		t.Fatal("get fallback error", v, err)
+	}
+	b := NewTreeBuffer()
+	b.Set("get.timeout", "1m30s")
+	b.Set("get.timeouts", "1s;2ms")
+	b.Set("get.port", "8080")
+	b.Set("get.small", "300")
+	b.Set("get.ports", "80;443")
+	b.Set("get.map.A", "1")
+	b.Set("get.ip", "10.0.0.1")
+	b.Set("get.item.name", "n")
+	b.Set(`get."a,b"`, "comma")
+	if v, err := GetFrom[time.Duration](b, "get.timeout"); err != nil || v != 90*time.Second {
+		t.Fatal("get duration error", err, v)
+	}
+	if v, err := GetFrom[[]time.Duration](b, "get.timeouts"); err != nil || len(v) != 2 || v[1] != 2*time.Millisecond {
+		t.Fatal("get durations error", err, v)
+	}
+	if v, err := GetFrom[uint16](b, "get.port"); err != nil || v != 8080 {
+		t.Fatal("get uint error", err, v)
+	}
+	if _, err := GetFrom[int8](b, "get.small"); err == nil {
+		t.Fatal("int8 overflow should fail")
+	}
+	if v, err := GetFrom[[]int32](b, "get.ports"); err != nil || len(v) != 2 || v[1] != 443 {
+		t.Fatal("get int32 slice error", err, v)
+	}
+	if v, err := GetFrom[map[string]string](b, "get.map"); err != nil || v["A"] != "1" {
+		t.Fatal("get map error", err, v)
+	}
+	if v, err := GetFrom[net.IP](b, "get.ip"); err != nil || !v.Equal(net.IPv4(10, 0, 0, 1)) {
+		t.Fatal("get text unmarshaler error", err, v)
+	}
+	if v, err := GetFrom[MapStruct](b, "get.item"); err == nil || v.Field1 != "" {
+		t.Fatal("get struct with missing fields should fail", v)
+	}
+	if v, err := GetFrom[string](b, `get."a,b"`); err != nil || v != "comma" {
+		t.Fatal("get quoted key error", err, v)
+	}
+	if _, err := GetFrom[string](b, "get.none"); err == nil {
+		t.Fatal("missing key should fail")
+	}
+	if v, err := GetOrFrom(b, "get.none", 80); err != nil || v != 80 {
+		t.Fatal("get fallback error", v, err)
+	}
+	b.Set("get.bad", "80x")
+	if _, err := GetOrFrom(b, "get.bad", 80); err == nil {
+		t.Fatal("conversion error should not be the fallback")
+	}
+
+	// maps of numbers and uint slices
+	b.Set("get.portmap.http", "80")
+	b.Set("get.portmap.https", "443")
+	b.Set("get.uints", "1;2;300")
+	if m, err := GetFrom[map[string]int](b, "get.portmap"); err != nil || m["https"] != 443 {
+		t.Fatal("get int map error", m, err)
+	}
+	if m, err := GetFrom[map[string]uint8](b, "get.portmap"); err == nil {
+		t.Fatal("map value overflow should fail", m)
+	}
+	if u, err := GetFrom[[]uint](b, "get.uints"); err != nil || len(u) != 3 || u[2] != 300 {
+		t.Fatal("get uint slice error", u, err)
+	}
+	if _, err := GetFrom[[]uint8](b, "get.uints"); err == nil {
+		t.Fatal("uint slice overflow should fail")
+	}
+	fb := map[string]int{"x": 1}
+	if m, err := GetOrFrom(b, "get.none", fb); err != nil || m["x"] != 1 {
+		t.Fatal("map fallback error", m, err)
+	}
+	// kinds Var doesn't convert are type errors
+	if _, err := GetFrom[complex128](b, "get.port"); err == nil {
+		t.Fatal("complex should fail")
+	}
+	if _, err := GetFrom[*int](b, "get.port"); err == nil {
+		t.Fatal("pointer to int should fail")
+	}
+	if _, err := GetOrFrom[complex128](b, "get.none", 1); err == nil {
+		t.Fatal("unsupported type should fail before the fallback")
+	}
+	if _, err := GetFrom[map[string][]int](b, "get.portmap"); err == nil {
+		t.Fatal("map of slices should fail")
+	}
+	if _, err := GetFrom[[][]string](b, "get.uints"); err == nil {
+		t.Fatal("slice of slices should fail")
+	}
+}
+
+type PoolConfig struct {
+	Host     string `conf:"host"`
+	Port     int    `conf:"port,default(1521)"`
+	Password string `conf:"password,omit"`
+}
+
+func TestSub(t *testing.T) {
+	b := NewTreeBuffer()
+	b.Set("wx.oracle.host", "primary")
+	b.Set("wx.oracle_backup.host", "backup")
+	b.Set("wx.oracle_backup.port", "1522")
+	b.Set("wx.oracle_backup.key", "k")
+	b.MarkSecret("wx.oracle_backup.key")
+	sub := b.Sub("wx.oracle_backup")
+	if v, _ := sub.GetString("host", ""); v != "backup" {
+		t.Fatal("sub getter error", v)
+	}
+	if !sub.IsSecret("key") {
+		t.Fatal("sub secret mark error")
+	}
+	cfg := PoolConfig{}
+	if err := sub.Var(&cfg); err != nil || cfg.Host != "backup" || cfg.Port != 1522 {
+		t.Fatal("sub var error", err, cfg)
+	}
+	cfg = PoolConfig{}
+	if err := b.VarAt("wx.oracle", &cfg); err != nil || cfg.Host != "primary" || cfg.Port != 1521 {
+		t.Fatal("var at error", err, cfg)
+	}
+	if _, err := b.Sub("wx.none").GetString("host", ""); !IsKeyNotFound(err) {
+		t.Fatal("missing prefix should be empty", err)
+	}
+}
+
+func TestWalk(t *testing.T) {
+	b := NewTreeBuffer()
+	b.Set("walk.B", "2")
+	b.Set("walk.a", "1")
+	b.Set(`walk."x.y"`, "3")
+	b.Set("walk.list.0", "l0")
+	b.Set("walk.list.1.name", "l1")
+	b.Set("other", "o")
+	if keys := b.Keys("WALK"); strings.Join(keys, ",") != `walk."x.y",walk.B,walk.a,walk.list.0,walk.list.1.name` {
+		t.Fatal("keys error", keys)
+	}
+	if keys := b.Keys(""); len(keys) != 6 || keys[0] != "other" {
+		t.Fatal("all keys error", keys)
+	}
+	var walked []string
+	stop := errors.New("stop")
+	err := b.Walk(func(key, value string) error {
+		walked = append(walked, key+"="+value)
+		if key == "walk.B" {
+			return stop
+		}
+		return nil
+	})
+	if err != stop || strings.Join(walked, ",") != `other=o,walk."x.y"=3,walk.B=2` {
+		t.Fatal("walk error", err, walked)
+	}
+	lb := NewTreeBuffer()
+	for _, k := range []string{"list.10", "list.2", "list.1.name", "list.b"} {
+		lb.Set(k, "v")
+	}
+	if keys := lb.Keys(""); strings.Join(keys, ",") != "list.1.name,list.2,list.10,list.b" {
+		t.Fatal("numeric keys order error", keys)
+	}
+	if changes := Diff(nil, lb); changes[1].Key != "list.2" || changes[2].Key != "list.10" {
+		t.Fatal("numeric diff order error", changes)
+	}
+	if !b.Has("walk.list") || b.IsSet("walk.list") || !b.IsSet("walk.a") || b.Has("walk.none") {
+		t.Fatal("has and is set error")
+	}
+	all := b.AllSettings()
+	walk := all["walk"].(map[string]interface{})
+	list, ok := walk["list"].([]interface{})
+	if !ok || len(list) != 2 || list[0] != "l0" || list[1].(map[string]interface{})["name"] != "l1" || walk["B"] != "2" || walk["x.y"] != "3" {
+		t.Fatal("all settings error", all)
+	}
+}
+
+func TestExplain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "configuration")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"config.ini": `# comment
+origin.host = localhost
+origin.port = abc
+[profile:prod]
+origin.host = prod
+`,
+		"config.prod.ini": "origin.host = 10.0.0.1\n",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.Setenv("ORIGIN_USER", "env")
+	defer os.Unsetenv("ORIGIN_USER")
+	file := filepath.Join(dir, "config.ini")
+	b, err := NewFileProvider(file).WithProfiles("prod").GetBuffer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := b.Explain("origin.host")
+	if len(chain) != 3 || chain[0].String() != "file "+file+":2" || chain[1].Line != 5 ||
+		chain[2].Source != filepath.Join(dir, "config.prod.ini") || chain[2].Value != "10.0.0.1" {
+		t.Fatal("explain chain error", chain)
+	}
+	if chain[0].Value != "localhost" || chain[1].Value != "prod" {
+		t.Fatal("explain overridden values error", chain)
+	}
+	if p := b.view().find([]string{"origin"}); p.origins["host"][2].Value != "" {
+		t.Fatal("current value stored in its origin")
+	}
+	if chain := b.Explain("origin_user"); len(chain) != 1 || chain[0].String() != "env ORIGIN_USER" {
+		t.Fatal("explain env error", chain)
+	}
+	cfg := struct {
+		Port int `conf:"origin.port"`
+	}{}
+	if err := b.Var(&cfg); err == nil || !strings.Contains(err.Error(), file+":3") {
+		t.Fatal("var error should name the origin", err)
+	}
+	def := struct {
+		Port int `conf:"origin.none,default(x)"`
+	}{}
+	if err := b.Var(&def); err == nil || !strings.Contains(err.Error(), "from default") {
+		t.Fatal("var error should name the default", err)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	b := NewTreeBuffer()
+	b.Set("snap.a.host", "1")
+	b.Set("snap.b.host", "1")
+	sub := b.Sub("snap")
+	src := NewTreeBuffer()
+	src.Set("snap.a.host", "2")
+	src.Set("snap.c.host", "2")
+	b.MergeFrom(src, true)
+	b.Set("snap.b.host", "3")
+	if v, _ := sub.GetString("a.host", ""); v != "1" {
+		t.Fatal("snapshot changed by merge", v)
+	}
+	if v, _ := sub.GetString("b.host", ""); v != "1" {
+		t.Fatal("snapshot changed by set", v)
+	}
+	if v, _ := b.GetString("snap.a.host", ""); v != "2" {
+		t.Fatal("merge error", v)
+	}
+	// nodes shared by the merge aren't changed through b
+	b.Set("snap.a.host", "4")
+	b.Set("snap.c.host", "4")
+	if v, _ := src.GetString("snap.c.host", ""); v != "2" {
+		t.Fatal("merged source changed", v)
+	}
+}
+
+func TestClone(t *testing.T) {
+	b := NewTreeBuffer()
+	b.Set("clone.host", "a")
+	b.Set("clone.key", "k")
+	b.MarkSecret("clone.key")
+	c := b.Clone()
+	c.Set("clone.host", "b")
+	b.Set("clone.port", "1")
+	if v, _ := b.GetString("clone.host", ""); v != "a" {
+		t.Fatal("clone changed the source", v)
+	}
+	if c.IsSet("clone.port") || !c.IsSecret("clone.key") {
+		t.Fatal("clone error")
+	}
+	src := NewTreeBuffer()
+	src.Set("clone.env.host", "e")
+	b.MergeFrom(src, false)
+	src.Set("clone.env.host", "f")
+	if v, _ := b.GetString("clone.env.host", ""); v != "e" {
+		t.Fatal("merged buffer changed by source", v)
+	}
+	m, _ := b.GetMap("clone", "")
+	m["host"] = "x"
+	children, _ := b.GetMapChild("clone")
+	children["env"].Set("host", "x")
+	if v, _ := b.GetString("clone.host", ""); v != "a" {
+		t.Fatal("buffer changed through map", v)
+	}
+	if v, _ := b.GetString("clone.env.host", ""); v != "e" {
+		t.Fatal("buffer changed through child", v)
+	}
+}
+
+// run with -race
+func TestConcurrency(t *testing.T) {
+	b := NewTreeBuffer()
+	b.Set("race.host", "h")
+	b.Set("race.port", "1")
+	type raceConfig struct {
+		Host  string            `conf:"race.host"`
+		Port  int               `conf:"race.port"`
+		Ports []int             `conf:"race.ports,default(1;2)"`
+		Extra map[string]string `conf:"race.extra,omit"`
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	run := func(fn func(i int) error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				if err := fn(i); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	run(func(i int) error {
+		b.Set("race.port", strconv.Itoa(i))
+		b.Set("race.extra.k"+strconv.Itoa(i%10), "v")
+		return nil
+	})
+	run(func(i int) error {
+		src := NewTreeBuffer()
+		src.Set("race.extra.m", strconv.Itoa(i))
+		b.MergeFrom(src, i%2 == 0)
+		src.Set("race.extra.m", "changed")
+		return nil
+	})
+	run(func(i int) error {
+		b.Delete("race.extra.k" + strconv.Itoa(i%10))
+		b.Clone().Set("race.host", "clone")
+		return nil
+	})
+	run(func(i int) error {
+		if v, err := b.GetString("race.host", ""); err != nil || v != "h" {
+			return errors.New("get error " + v)
+		}
+		if m, err := b.GetMap("race.extra", "x:y"); err == nil {
+			m["k"] = "v"
+		}
+		b.AllSettings()
+		_ = b.String()
+		return nil
+	})
+	run(func(i int) error {
+		cfg := raceConfig{}
+		if err := b.Var(&cfg); err != nil {
+			return err
+		}
+		if cfg.Host != "h" || len(cfg.Ports) != 2 {
+			return errors.New("var error")
+		}
+		return nil
+	})
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	if v, _ := b.GetString("race.port", ""); v != "499" {
+		t.Fatal("last set lost", v)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	old := NewTreeBuffer()
+	old.Set("diff.host", "a")
+	old.Set("diff.Port", "1")
+	old.Set("diff.db.user", "u")
+	new := NewTreeBuffer()
+	new.Set("diff.host", "b")
+	new.Set("diff.port", "1")
+	new.Set("diff.\"a.b\"", "x")
+	new.Set("diff.db.pass", "p")
+	changes := Diff(old, new)
+	want := []Change{
+		{Key: `diff."a.b"`, Kind: ChangeAdd, New: "x"},
+		{Key: "diff.db.pass", Kind: ChangeAdd, New: "p"},
+		{Key: "diff.db.user", Kind: ChangeDelete, Old: "u"},
+		{Key: "diff.host", Kind: ChangeUpdate, Old: "a", New: "b"},
+	}
+	if len(changes) != len(want) {
+		t.Fatal("diff error", changes)
+	}
+	for i := range want {
+		if changes[i] != want[i] {
+			t.Fatal("diff error", i, changes[i])
+		}
+	}
+	if len(Diff(nil, nil)) != 0 || len(Diff(nil, new)) != 4 {
+		t.Fatal("diff of nil error")
+	}
+	if err := old.Patch(changes); err != nil {
+		t.Fatal(err)
+	}
+	if d := Diff(old, new); len(d) != 0 {
+		t.Fatal("patch error", d)
+	}
+	if err := old.Patch([]Change{{Key: "diff.host", Kind: "move"}}); err == nil {
+		t.Fatal("unknown kind should fail")
+	}
+}
+
+type bindConfig struct {
+	Host string `conf:"host"`
+	Port int    `conf:"port,default(80)"`
+}
+
+func (c *bindConfig) Validate() error {
+	if c.Port <= 0 {
+		return errors.New("invalid port")
+	}
+	return nil
+}
+
+func TestBind(t *testing.T) {
+	p := &flakyProvider{values: map[string]string{"app.host": "a"}}
+	d := &Driver{Provider: p}
+	b, err := BindFrom[bindConfig](d, "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := b.Load(); c.Host != "a" || c.Port != 80 {
+		t.Fatal("bind error", c)
+	}
+	var changes []string
+	b.OnChange(func(old, new *bindConfig) {
+		// listeners are called without the lock
+		if b.Err() == nil && len(changes) == 0 {
+			b.OnChange(func(old, new *bindConfig) {})
+		}
+		changes = append(changes, old.Host+"->"+new.Host)
+	})
+	first := b.Load()
+	p.values = map[string]string{"app.host": "b", "app.port": "8080"}
+	if err := d.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if c := b.Load(); c.Host != "b" || c.Port != 8080 || first.Host != "a" {
+		t.Fatal("bind reload error", c, first)
+	}
+	p.values = map[string]string{"app.host": "c", "app.port": "-1"}
+	d.Reload()
+	if c := b.Load(); c.Host != "b" || b.Err() == nil {
+		t.Fatal("invalid value published", c)
+	}
+	p.values = map[string]string{"app.host": "b", "app.port": "8080"}
+	d.Reload()
+	if b.Err() != nil || len(changes) != 1 || changes[0] != "a->b" {
+		t.Fatal("bind change error", b.Err(), changes)
+	}
+	if _, err := BindFrom[bindConfig](d, "none"); err == nil {
+		t.Fatal("missing value should fail")
+	}
+	p.values = map[string]string{"app.port": "x"}
+	d.Reload()
+	if b.Err() == nil {
+		t.Fatal("type error should be kept")
+	}
+}
+
+type bindInner struct {
+	X string `conf:"x,default(x)"`
+}
+
+func TestBindCopy(t *testing.T) {
+	cfg := struct {
+		Host  string     `conf:"bind.none.host,default(h)"`
+		Inner *bindInner `conf:"bind.none.inner,omit"`
+	}{Inner: &bindInner{}}
+	b, err := Bind(&cfg)
+	if err != nil || cfg.Host != "h" {
+		t.Fatal("bind error", cfg, err)
+	}
+	cfg.Host = "changed"
+	cfg.Inner.X = "changed"
+	if c := b.Load(); c.Host != "h" || (c.Inner != nil && c.Inner.X == "changed") {
+		t.Fatal("bind published the caller's struct", c)
+	}
+}
+
+func TestBindClose(t *testing.T) {
+	p := &flakyProvider{values: map[string]string{"app.host": "a"}}
+	d := &Driver{Provider: p}
+	b, err := BindFrom[bindConfig](d, "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Close()
+	if len(d.listeners) != 0 {
+		t.Fatal("listener of a closed binding kept", len(d.listeners))
+	}
+	p.values = map[string]string{"app.host": "b"}
+	d.Reload()
+	if c := b.Load(); c.Host != "a" {
+		t.Fatal("closed binding changed", c)
+	}
+}
@@ -0,0 +1,372 @@
+// Package configserver serves a configuration provider over HTTP.
+//
+// Endpoints:
+//
+//	GET /v1/key/<key>            value of a key
+//	GET /v1/tree[/<prefix>]      all values under prefix, keys relative to prefix
+//	GET /v1/watch?index=N        long-poll change events after index N,
+//	                             with Accept: text/event-stream they are streamed
+//
+// Values are json by default, format=ini returns "key = value" lines.
+// The tree endpoint answers If-None-Match with the current index as ETag,
+// so "http::http://host:8080/v1/tree/app?format=ini" can be used as a
+// provider by other services.
+package configserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gogs.xlh/tools/configuration"
+)
+
+const (
+	EventAdd    = "add"
+	EventUpdate = "update"
+	EventDelete = "delete"
+	// the client's index is older than the kept events, reload the tree
+	EventReset = "reset"
+)
+
+const (
+	defaultMaxEvents = 1000
+	defaultWait      = 30 * time.Second
+	maxWait          = 5 * time.Minute
+)
+
+// change of a key, events of one reload share the index
+type Event struct {
+	Index uint64 `json:"index"`
+	Kind  string `json:"kind"`
+	Key   string `json:"key,omitempty"`
+	Old   string `json:"old,omitempty"`
+	New   string `json:"new,omitempty"`
+}
+
+type Server struct {
+	Driver *configuration.Driver
+	// mask secret values, see TreeBuffer.IsSecret. NewServer turns it on,
+	// the server has no authentication
+	Redact bool
+	// number of events kept for watchers
+	MaxEvents int
+
+	lock    sync.Mutex
+	index   uint64
+	events  []Event
+	changed chan struct{}
+	mux     *http.ServeMux
+}
+
+// load the provider, eg. "file::./config.ini", and create its server
+func New(provider string) (*Server, error) {
+	d := &configuration.Driver{}
+	if err := d.ParseProvider(provider); err != nil {
+		return nil, err
+	}
+	if _, err := d.LoadProvider(); err != nil {
+		return nil, err
+	}
+	if _, err := d.Provider.GetBuffer(); err != nil {
+		return nil, err
+	}
+	return NewServer(d), nil
+}
+
+// create server of a loaded driver
+func NewServer(d *configuration.Driver) *Server {
+	s := &Server{
+		Driver:    d,
+		Redact:    true,
+		MaxEvents: defaultMaxEvents,
+		index:     1,
+		changed:   make(chan struct{}),
+		mux:       http.NewServeMux(),
+	}
+	s.mux.HandleFunc("/v1/key/", s.handleKey)
+	s.mux.HandleFunc("/v1/tree", s.handleTree)
+	s.mux.HandleFunc("/v1/tree/", s.handleTree)
+	s.mux.HandleFunc("/v1/watch", s.handleWatch)
+	d.OnChange(s.onChange)
+	return s
+}
+
+// reload on provider changes until stop is closed
+func (s *Server) Watch(stop <-chan struct{}) error {
+	return s.Driver.Watch(stop)
+}
+
+// call fn with every error of Watch, Watch retries after it
+func (s *Server) OnWatchError(fn func(err error)) {
+	s.Driver.OnWatchError(fn)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *Server) buffer() (*configuration.TreeBuffer, error) {
+	return s.Driver.Provider.GetBuffer()
+}
+
+func (s *Server) value(b *configuration.TreeBuffer, key, value string) string {
+	if s.Redact && b.IsSecret(key) {
+		return configuration.SecretMask
+	}
+	return value
+}
+
+func (s *Server) onChange(old, new *configuration.TreeBuffer) {
+	ov, nv := flatten(old), flatten(new)
+	var events []Event
+	for k, v := range nv {
+		if o, ok := ov[k]; !ok {
+			events = append(events, Event{Kind: EventAdd, Key: k, New: s.value(new, k, v)})
+		} else if o != v {
+			events = append(events, Event{Kind: EventUpdate, Key: k, Old: s.value(new, k, o), New: s.value(new, k, v)})
+		}
+	}
+	for k, o := range ov {
+		if _, ok := nv[k]; !ok {
+			events = append(events, Event{Kind: EventDelete, Key: k, Old: s.value(old, k, o)})
+		}
+	}
+	if len(events) == 0 {
+		return
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].Key < events[j].Key })
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.index++
+	for i := range events {
+		events[i].Index = s.index
+	}
+	s.events = append(s.events, events...)
+	if max := s.MaxEvents; max > 0 && len(s.events) > max {
+		s.events = append([]Event(nil), s.events[len(s.events)-max:]...)
+	}
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// events after index, the current index and a channel closed on the next change
+func (s *Server) since(index uint64) ([]Event, uint64, <-chan struct{}) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if index >= s.index {
+		return nil, s.index, s.changed
+	}
+	if len(s.events) == 0 || s.events[0].Index > index+1 {
+		return []Event{{Index: s.index, Kind: EventReset}}, s.index, s.changed
+	}
+	i := sort.Search(len(s.events), func(i int) bool { return s.events[i].Index > index })
+	return append([]Event(nil), s.events[i:]...), s.index, s.changed
+}
+
+func (s *Server) currentIndex() uint64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.index
+}
+
+func (s *Server) handleKey(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/v1/key/")
+	b, err := s.buffer()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	v, berr := b.GetRaw(key)
+	if berr == nil && fromEnv(b, key) {
+		http.Error(w, "no value of "+key, http.StatusNotFound)
+		return
+	}
+	if configuration.IsKeyNotFound(berr) {
+		http.Error(w, berr.Error(), http.StatusNotFound)
+		return
+	} else if berr != nil {
+		http.Error(w, berr.Error(), http.StatusInternalServerError)
+		return
+	}
+	v = s.value(b, key, v)
+	if r.URL.Query().Get("format") == "ini" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintf(w, "%s = %s\n", key, v)
+		return
+	}
+	writeJSON(w, map[string]string{"key": key, "value": v})
+}
+
+func (s *Server) handleTree(w http.ResponseWriter, r *http.Request) {
+	prefix := strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1/tree"), "/")
+	etag := strconv.Quote(strconv.FormatUint(s.currentIndex(), 10))
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	b, err := s.buffer()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	node := b
+	if len(prefix) > 0 {
+		node = b.Sub(prefix)
+		if len(node.Keys("")) == 0 {
+			http.Error(w, "no keys with prefix "+prefix, http.StatusNotFound)
+			return
+		}
+	}
+	w.Header().Set("ETag", etag)
+	if r.URL.Query().Get("format") == "ini" {
+		values := flatten(node)
+		keys := make([]string, 0, len(values))
+		for k := range values {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, k := range keys {
+			fmt.Fprintf(w, "%s = %s\n", k, s.value(b, joinKey(prefix, k), values[k]))
+		}
+		return
+	}
+	writeJSON(w, s.nest(b, node, prefix))
+}
+
+func (s *Server) handleWatch(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	index, _ := strconv.ParseUint(q.Get("index"), 10, 64)
+	if id := r.Header.Get("Last-Event-ID"); len(id) > 0 {
+		index, _ = strconv.ParseUint(id, 10, 64)
+	}
+	if strings.Contains(r.Header.Get("Accept"), "text/event-stream") || q.Get("stream") == "sse" {
+		s.stream(w, r, index)
+		return
+	}
+	wait := defaultWait
+	if d, err := time.ParseDuration(q.Get("wait")); err == nil && d > 0 {
+		wait = d
+	}
+	if wait > maxWait {
+		wait = maxWait
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		events, cur, changed := s.since(index)
+		if len(events) > 0 {
+			writeJSON(w, map[string]interface{}{"index": cur, "events": events})
+			return
+		}
+		select {
+		case <-changed:
+		case <-timer.C:
+			writeJSON(w, map[string]interface{}{"index": cur, "events": []Event{}})
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// server-sent events, the event id is the index
+func (s *Server) stream(w http.ResponseWriter, r *http.Request, index uint64) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	if index == 0 {
+		index = s.currentIndex()
+	}
+	for {
+		events, cur, changed := s.since(index)
+		for _, e := range events {
+			bts, _ := json.Marshal(e)
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.Index, e.Kind, bts)
+		}
+		if len(events) > 0 {
+			flusher.Flush()
+		}
+		index = cur
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(v)
+}
+
+func joinKey(prefix, key string) string {
+	if len(prefix) == 0 {
+		return key
+	}
+	return prefix + "." + key
+}
+
+// all values of the buffer by dotted keys. values are served as set,
+// file references aren't read so local files are never exposed, and
+// values of the server's environment are left out
+func flatten(b *configuration.TreeBuffer) map[string]string {
+	values := make(map[string]string)
+	if b != nil {
+		b.WalkRaw(func(k, v string) error {
+			if !fromEnv(b, k) {
+				values[k] = v
+			}
+			return nil
+		})
+	}
+	return values
+}
+
+// whether the value of key came from the process environment, the
+// providers merge it into their buffers but it's the server's own
+func fromEnv(b *configuration.TreeBuffer, key string) bool {
+	chain := b.Explain(key)
+	return len(chain) > 0 && chain[len(chain)-1].Provider == "env"
+}
+
+// nested json objects of the buffer with the values as set, see flatten.
+// a value and children of the same key can't both be represented, the
+// children are kept
+func (s *Server) nest(root, b *configuration.TreeBuffer, pre string) map[string]interface{} {
+	m := make(map[string]interface{})
+	b.WalkRaw(func(k, v string) error {
+		ks, err := configuration.ParseKey(k)
+		if err != nil || fromEnv(b, k) {
+			return nil
+		}
+		parent := m
+		for _, seg := range ks[:len(ks)-1] {
+			c, ok := parent[seg].(map[string]interface{})
+			if !ok {
+				c = make(map[string]interface{})
+				parent[seg] = c
+			}
+			parent = c
+		}
+		if _, ok := parent[ks[len(ks)-1]].(map[string]interface{}); !ok {
+			parent[ks[len(ks)-1]] = s.value(root, joinKey(pre, k), v)
+		}
+		return nil
+	})
+	return m
+}
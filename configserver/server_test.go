@@ -0,0 +1,246 @@
+package configserver
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gogs.xlh/tools/configuration"
+)
+
+// provider whose next reload returns the values set with set
+type memProvider struct {
+	lock   sync.Mutex
+	buffer *configuration.TreeBuffer
+	next   map[string]string
+}
+
+func (m *memProvider) GetBuffer() (*configuration.TreeBuffer, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.buffer, nil
+}
+
+func (m *memProvider) Reload() (*configuration.TreeBuffer, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	b := configuration.NewTreeBuffer()
+	for k, v := range m.next {
+		b.Set(k, v)
+	}
+	m.buffer = b
+	return b, nil
+}
+
+func newTestServer(t *testing.T) (*Server, *memProvider, *httptest.Server) {
+	p := &memProvider{next: map[string]string{
+		"wx.oracle.host":     "db1",
+		"wx.oracle.password": "p4ss",
+		"wx.mp.appid":        "app",
+	}}
+	p.Reload()
+	s := NewServer(&configuration.Driver{Provider: p})
+	ts := httptest.NewServer(s)
+	return s, p, ts
+}
+
+func get(t *testing.T, url string, v interface{}) *http.Response {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp
+}
+
+func TestKeyAndTree(t *testing.T) {
+	s, _, ts := newTestServer(t)
+	defer ts.Close()
+	if !s.Redact {
+		t.Fatal("secrets should be masked by default")
+	}
+
+	var kv map[string]string
+	get(t, ts.URL+"/v1/key/wx.oracle.host", &kv)
+	if kv["value"] != "db1" {
+		t.Fatal("key value error", kv)
+	}
+	if resp := get(t, ts.URL+"/v1/key/wx.none", nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatal("missing key status", resp.Status)
+	}
+
+	var tree map[string]map[string]interface{}
+	get(t, ts.URL+"/v1/tree/wx", &tree)
+	if tree["oracle"]["host"] != "db1" || tree["oracle"]["password"] != configuration.SecretMask {
+		t.Fatal("tree value error", tree)
+	}
+
+	resp, err := http.Get(ts.URL + "/v1/tree/wx.oracle?format=ini")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bts, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(bts) != "host = db1\npassword = ******\n" {
+		t.Fatalf("tree ini error %q", bts)
+	}
+
+	// the tree is usable as a provider backend
+	s.Redact = false
+	p, err := configuration.NewHTTPProvider(ts.URL + "/v1/tree/wx?format=ini")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := p.GetBuffer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := b.GetString("oracle.password", ""); v != "p4ss" {
+		t.Fatal("provider backend value error", v)
+	}
+}
+
+func TestFileReference(t *testing.T) {
+	f, err := ioutil.TempFile("", "configserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("l0cal")
+	f.Close()
+	s, p, ts := newTestServer(t)
+	defer ts.Close()
+	p.next["wx.mp.cert"] = "@file:" + f.Name()
+	if err := s.Driver.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	var kv map[string]string
+	get(t, ts.URL+"/v1/key/wx.mp.cert", &kv)
+	if kv["value"] != "@file:"+f.Name() {
+		t.Fatal("file reference read by key", kv)
+	}
+	var tree map[string]map[string]interface{}
+	get(t, ts.URL+"/v1/tree/wx", &tree)
+	if tree["mp"]["cert"] != "@file:"+f.Name() {
+		t.Fatal("file reference read by tree", tree)
+	}
+	resp, err := http.Get(ts.URL + "/v1/tree/wx.mp?format=ini")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bts, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if strings.Contains(string(bts), "l0cal") {
+		t.Fatalf("file reference read by tree ini %q", bts)
+	}
+}
+
+func TestEnvNotServed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "configserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "config.ini")
+	if err := ioutil.WriteFile(file, []byte("wx.host = db1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("CONFIGSERVER_DATABASE_URL", "postgres://u:hunter2@db/x")
+	defer os.Unsetenv("CONFIGSERVER_DATABASE_URL")
+	s, err := New("file::" + file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	if resp := get(t, ts.URL+"/v1/key/CONFIGSERVER_DATABASE_URL", nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatal("env value served", resp.Status)
+	}
+	var kv map[string]string
+	get(t, ts.URL+"/v1/key/wx.host", &kv)
+	if kv["value"] != "db1" {
+		t.Fatal("file value error", kv)
+	}
+	for _, path := range []string{"/v1/tree", "/v1/tree?format=ini"} {
+		resp, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bts, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if strings.Contains(string(bts), "hunter2") || !strings.Contains(string(bts), "db1") {
+			t.Fatalf("env value served by %s %q", path, bts)
+		}
+	}
+}
+
+func TestWatch(t *testing.T) {
+	s, p, ts := newTestServer(t)
+	defer ts.Close()
+
+	done := make(chan map[string]interface{}, 1)
+	go func() {
+		var r map[string]interface{}
+		get(t, ts.URL+"/v1/watch?index=1&wait=5s", &r)
+		done <- r
+	}()
+	time.Sleep(50 * time.Millisecond)
+	p.lock.Lock()
+	p.next["wx.oracle.host"] = "db2"
+	delete(p.next, "wx.mp.appid")
+	p.lock.Unlock()
+	if err := s.Driver.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case r := <-done:
+		events := r["events"].([]interface{})
+		if len(events) != 2 {
+			t.Fatal("watch events error", r)
+		}
+		e := events[1].(map[string]interface{})
+		if e["kind"] != EventUpdate || e["key"] != "wx.oracle.host" || e["new"] != "db2" {
+			t.Fatal("watch event error", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("watch timeout")
+	}
+
+	// stream from index 1 replays the events above
+	req, _ := http.NewRequest("GET", ts.URL+"/v1/watch?index=1", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	r := bufio.NewReader(resp.Body)
+	var lines []string
+	for len(lines) < 3 {
+		l, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if l = strings.TrimSpace(l); len(l) > 0 {
+			lines = append(lines, l)
+		}
+	}
+	if lines[0] != "id: 2" || lines[1] != "event: delete" {
+		t.Fatal("stream event error", lines)
+	}
+}
@@ -0,0 +1,197 @@
+package configuration
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	RegisterProvider("consul", func(param string) (Provider, error) {
+		return NewConsulProvider(param)
+	})
+}
+
+// consul kv provider, param eg. http://host:8500/prefix?token=xxx&wait=5m
+// the acl token falls back to env CONSUL_HTTP_TOKEN,
+// wait is the max duration of a blocking query used by WaitChange,
+// timeout the max duration of a load (default 10s)
+type ConsulProvider struct {
+	addr    string
+	prefix  string
+	token   string
+	wait    string
+	timeout time.Duration
+	client  *http.Client
+
+	index  uint64
+	buffer *TreeBuffer
+	lock   sync.RWMutex
+}
+
+type consulKV struct {
+	Key   string
+	Value []byte
+}
+
+func NewConsulProvider(cp string) (*ConsulProvider, error) {
+	u, err := url.Parse(cp)
+	if err != nil {
+		return nil, err
+	}
+	if len(u.Host) == 0 {
+		return nil, fmt.Errorf("consul provider address in error [%s]", cp)
+	}
+	q := u.Query()
+	c := &ConsulProvider{
+		addr:    u.Scheme + "://" + u.Host,
+		prefix:  strings.TrimLeft(u.Path, "/"),
+		token:   q.Get("token"),
+		wait:    q.Get("wait"),
+		timeout: 10 * time.Second,
+	}
+	if len(c.prefix) > 0 && !strings.HasSuffix(c.prefix, "/") {
+		c.prefix += "/"
+	}
+	if len(c.token) == 0 {
+		c.token = os.Getenv("CONSUL_HTTP_TOKEN")
+	}
+	if len(c.wait) == 0 {
+		c.wait = "5m"
+	}
+	wait, err := time.ParseDuration(c.wait)
+	if err != nil {
+		return nil, err
+	}
+	if t := q.Get("timeout"); len(t) > 0 {
+		if c.timeout, err = time.ParseDuration(t); err != nil {
+			return nil, err
+		}
+	}
+	// consul adds up to wait/16 jitter to blocking queries
+	c.client = &http.Client{Timeout: wait + wait/16 + c.timeout}
+	return c, nil
+}
+
+// query the kv prefix recursive, with index > 0 it's a blocking query
+func (c *ConsulProvider) query(ctx context.Context, index uint64) ([]consulKV, uint64, error) {
+	q := url.Values{}
+	q.Set("recurse", "true")
+	if index > 0 {
+		q.Set("index", strconv.FormatUint(index, 10))
+		q.Set("wait", c.wait)
+	} else {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+	req, err := http.NewRequest("GET", c.addr+"/v1/kv/"+c.prefix+"?"+q.Encode(), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	req = req.WithContext(ctx)
+	if len(c.token) > 0 {
+		req.Header.Set("X-Consul-Token", c.token)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	newIndex, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, newIndex, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("consul provider response status %v", resp.Status)
+	}
+	var kvs []consulKV
+	if err = json.NewDecoder(resp.Body).Decode(&kvs); err != nil {
+		return nil, 0, err
+	}
+	return kvs, newIndex, nil
+}
+
+func (c *ConsulProvider) loadConsul() (*TreeBuffer, error) {
+	kvs, index, err := c.query(context.Background(), 0)
+	if err != nil {
+		return nil, err
+	}
+	buffer := NewTreeBuffer()
+	for _, kv := range kvs {
+		// folders have a trailing slash and no value
+		if strings.HasSuffix(kv.Key, "/") {
+			continue
+		}
+		k := strings.TrimPrefix(kv.Key, c.prefix)
+		buffer.SetOrigin(Origin{Provider: "consul", Source: kv.Key})
+		buffer.SetIn(strings.Split(k, "/"), string(kv.Value))
+	}
+	buffer.SetOrigin(Origin{})
+	envBuffer, _ := NewEnvProvider().GetBuffer()
+	buffer.MergeFrom(envBuffer, false)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.buffer = buffer
+	c.index = index
+	return buffer, nil
+}
+
+func (c *ConsulProvider) GetBuffer() (*TreeBuffer, error) {
+	c.lock.RLock()
+	buffer := c.buffer
+	c.lock.RUnlock()
+	if buffer == nil {
+		return c.loadConsul()
+	}
+	return buffer, nil
+}
+
+func (c *ConsulProvider) Reload() (*TreeBuffer, error) {
+	return c.loadConsul()
+}
+
+// wait for changes of the prefix with consul blocking queries
+func (c *ConsulProvider) WaitChange(stop <-chan struct{}) (bool, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	c.lock.RLock()
+	index := c.index
+	c.lock.RUnlock()
+	for {
+		// index 0 isn't a blocking query, start from 1
+		if index == 0 {
+			index = 1
+		}
+		_, newIndex, err := c.query(ctx, index)
+		if err != nil {
+			select {
+			case <-stop:
+				return false, nil
+			default:
+				return false, err
+			}
+		}
+		if newIndex == 0 {
+			return false, fmt.Errorf("consul provider response without index")
+		}
+		// the index going backwards means the consul state was reset
+		if newIndex != index {
+			return true, nil
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package configuration
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// in-memory stand-in for the consul kv endpoints
+type fakeConsul struct {
+	lock    sync.Mutex
+	kvs     map[string]string
+	index   uint64
+	changed chan struct{}
+	token   string
+}
+
+func newFakeConsul(token string) *fakeConsul {
+	return &fakeConsul{kvs: map[string]string{}, index: 1, changed: make(chan struct{}), token: token}
+}
+
+func (f *fakeConsul) put(k, v string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.kvs[k] = v
+	f.index++
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+func (f *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-Consul-Token") != f.token {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	prefix := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+	if idx, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64); idx > 0 {
+		f.lock.Lock()
+		index, changed := f.index, f.changed
+		f.lock.Unlock()
+		if idx == index {
+			select {
+			case <-changed:
+			case <-time.After(time.Second):
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(f.index, 10))
+	var kvs []consulKV
+	for k, v := range f.kvs {
+		if strings.HasPrefix(k, prefix) {
+			kvs = append(kvs, consulKV{Key: k, Value: []byte(v)})
+		}
+	}
+	if len(kvs) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(kvs)
+}
+
+func TestConsulProvider(t *testing.T) {
+	fc := newFakeConsul("acl-token")
+	fc.put("app/wx/oracle/host", "10.0.0.1")
+	fc.put("app/wx/oracle/port", "1521")
+	fc.put("app/folder/", "")
+	fc.put("application/other", "x")
+	fc.put("app/wx/a.b", `"q"`)
+	ts := httptest.NewServer(fc)
+	defer ts.Close()
+
+	d := &Driver{}
+	if err := d.ParseProvider("consul::" + ts.URL + "/app?token=acl-token&wait=1s"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.LoadProvider(); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := d.Buffer().GetString("wx.oracle.host", ""); err != nil || v != "10.0.0.1" {
+		t.Fatal("consul value error", v, err)
+	}
+	if v, err := d.Buffer().GetInt("wx.oracle.port", ""); err != nil || v != 1521 {
+		t.Fatal("consul value error", v, err)
+	}
+	if v, err := d.Buffer().GetIn([]string{"wx", "a.b"}); err != nil || v != `"q"` {
+		t.Fatal("consul key or value reinterpreted", v, err)
+	}
+	if _, err := d.Buffer().GetString("other", ""); err == nil {
+		t.Fatal("consul key outside prefix loaded")
+	}
+
+	changed := make(chan string, 1)
+	d.OnChange(func(old, new *TreeBuffer) {
+		v, _ := new.GetString("wx.oracle.host", "")
+		changed <- v
+	})
+	stop := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- d.Watch(stop)
+	}()
+	fc.put("app/wx/oracle/host", "10.0.0.2")
+	select {
+	case v := <-changed:
+		if v != "10.0.0.2" {
+			t.Fatal("consul watch value error", v)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("consul watch timeout")
+	}
+	close(stop)
+	if err := <-done; err != nil {
+		t.Fatal("consul watch error", err)
+	}
+
+	p, _ := NewConsulProvider(ts.URL + "/app?token=wrong")
+	if _, err := p.GetBuffer(); err == nil {
+		t.Fatal("consul acl token ignored")
+	}
+}
+
+func TestConsulTimeout(t *testing.T) {
+	block := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-block
+	}))
+	defer ts.Close()
+	defer close(block)
+	p, err := NewConsulProvider(ts.URL + "/app?timeout=100ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, err := p.GetBuffer(); err == nil {
+		t.Fatal("hanging consul should fail")
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatal("consul load ignored the timeout", d)
+	}
+	if _, err := NewConsulProvider(ts.URL + "/app?timeout=x"); err == nil {
+		t.Fatal("invalid timeout should fail")
+	}
+}
@@ -0,0 +1,130 @@
+package configuration
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+var errChangeKind = errors.New("cann't apply the change kind")
+
+type ChangeKind string
+
+// kinds of changes, the same as the events of configserver
+const (
+	ChangeAdd    ChangeKind = "add"
+	ChangeUpdate ChangeKind = "update"
+	ChangeDelete ChangeKind = "delete"
+)
+
+// change of a value between two buffers. Old is empty for added values
+// and New for deleted ones
+type Change struct {
+	Key  string
+	Kind ChangeKind
+	Old  string
+	New  string
+}
+
+// changes from old to new sorted by key, keys are joined with JoinKey
+// and compared case insensitively. values are compared as set, file
+// references aren't resolved and secret values aren't masked, see
+// IsSecret. nil buffers are empty
+func Diff(old, new *TreeBuffer) []Change {
+	ov, nv := diffValues(old), diffValues(new)
+	changes := []Change{}
+	for k, n := range nv {
+		if o, ok := ov[k]; !ok {
+			changes = append(changes, Change{Key: n.key, Kind: ChangeAdd, New: n.value})
+		} else if o.value != n.value {
+			changes = append(changes, Change{Key: n.key, Kind: ChangeUpdate, Old: o.value, New: n.value})
+		}
+	}
+	for k, o := range ov {
+		if _, ok := nv[k]; !ok {
+			changes = append(changes, Change{Key: o.key, Kind: ChangeDelete, Old: o.value})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		ki, kj := changes[i].Key, changes[j].Key
+		if c := compareKeys(diffKey(ki, ov, nv), diffKey(kj, ov, nv)); c != 0 {
+			return c < 0
+		}
+		return ki < kj
+	})
+	return changes
+}
+
+// lower case path of a changed key
+func diffKey(key string, ov, nv map[string]keyValue) []string {
+	k := strings.ToLower(key)
+	kv, ok := nv[k]
+	if !ok {
+		kv = ov[k]
+	}
+	ks := make([]string, len(kv.ks))
+	for i, s := range kv.ks {
+		ks[i] = strings.ToLower(s)
+	}
+	return ks
+}
+
+// values of b by lower case key
+func diffValues(b *TreeBuffer) map[string]keyValue {
+	m := make(map[string]keyValue)
+	if b == nil {
+		return m
+	}
+	b.each(nil, func(ks []string, value string) {
+		key := JoinKey(ks...)
+		m[strings.ToLower(key)] = keyValue{ks, key, value}
+	})
+	return m
+}
+
+// apply changes of Diff, added and updated keys are set to New and
+// deleted keys removed, the current values aren't checked against Old.
+// the changes are applied at once, readers see all or none of them
+func (t *TreeBuffer) Patch(changes []Change) *BufferError {
+	kss := make([][]string, len(changes))
+	for i, c := range changes {
+		ks, err := ParseKey(c.Key)
+		if err != nil {
+			return NewBufferError(err, c.Key)
+		}
+		switch c.Kind {
+		case ChangeAdd, ChangeUpdate, ChangeDelete:
+		default:
+			return NewBufferError(errChangeKind, c.Key+" "+string(c.Kind))
+		}
+		kss[i] = ks
+	}
+	t.write(func(root *node) {
+		for i, c := range changes {
+			ks := kss[i]
+			n := root
+			for _, k := range ks[:len(ks)-1] {
+				if _, ok := n.children[strings.ToLower(k)]; !ok && c.Kind == ChangeDelete {
+					n = nil
+					break
+				}
+				n = n.child(k, t.epoch)
+			}
+			if n == nil {
+				continue
+			}
+			name := ks[len(ks)-1]
+			if c.Kind == ChangeDelete {
+				k := strings.ToLower(name)
+				delete(n.data, k)
+				delete(n.dataNames, k)
+				delete(n.quoted, k)
+				delete(n.origins, k)
+			} else {
+				n.addOrigin(name, t.origin)
+				n.setData(name, c.New)
+			}
+		}
+	})
+	return nil
+}
@@ -0,0 +1,158 @@
+package configuration
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	RegisterProvider("dir", func(param string) (Provider, error) {
+		return NewDirProvider(param), nil
+	})
+}
+
+// kubernetes swaps this symlink atomically when a mounted configmap
+// or secret changes, the visible files link through it
+const k8sDataLink = "..data"
+
+const defaultDirInterval = 5 * time.Second
+
+// directory provider, every file name is a key and its content the value,
+// nested directories become dotted paths, eg. /etc/config/wx/oracle.host
+// is wx.oracle.host. hidden entries (like kubernetes' ..data) are skipped
+type DirProvider struct {
+	dir string
+	// polling period of WaitChange
+	Interval time.Duration
+
+	version string
+	buffer  *TreeBuffer
+	lock    sync.RWMutex
+}
+
+func NewDirProvider(dir string) *DirProvider {
+	return &DirProvider{dir: dir, Interval: defaultDirInterval}
+}
+
+func (d *DirProvider) loadDir() (*TreeBuffer, error) {
+	version, err := d.dirVersion()
+	if err != nil {
+		return nil, err
+	}
+	buffer := NewTreeBuffer()
+	if err = d.loadIn(buffer, d.dir, nil); err != nil {
+		return nil, err
+	}
+	buffer.SetOrigin(Origin{})
+	envBuffer, _ := NewEnvProvider().GetBuffer()
+	buffer.MergeFrom(envBuffer, false)
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.buffer = buffer
+	d.version = version
+	return buffer, nil
+}
+
+func (d *DirProvider) loadIn(buffer *TreeBuffer, dir string, ks []string) error {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, fi := range fis {
+		if strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+		name := filepath.Join(dir, fi.Name())
+		// follow symlinks, mounted files link through ..data
+		if fi, err = os.Stat(name); err != nil {
+			return err
+		}
+		cks := make([]string, len(ks), len(ks)+1)
+		copy(cks, ks)
+		cks = append(cks, strings.Split(fi.Name(), ".")...)
+		if fi.IsDir() {
+			if err = d.loadIn(buffer, name, cks); err != nil {
+				return err
+			}
+			continue
+		}
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+		bts, err := ioutil.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		buffer.SetOrigin(Origin{Provider: "dir", Source: name})
+		buffer.SetIn(cks, strings.TrimRight(string(bts), "\r\n"))
+	}
+	return nil
+}
+
+// the ..data link target if the directory is a kubernetes volume,
+// otherwise names, sizes and modification times of all files
+func (d *DirProvider) dirVersion() (string, error) {
+	if target, err := os.Readlink(filepath.Join(d.dir, k8sDataLink)); err == nil {
+		return k8sDataLink + ":" + target, nil
+	}
+	var version []string
+	err := filepath.Walk(d.dir, func(name string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if name != d.dir && strings.HasPrefix(fi.Name(), ".") {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		version = append(version, fmt.Sprintf("%s:%d:%d", name, fi.Size(), fi.ModTime().UnixNano()))
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return strings.Join(version, "\n"), nil
+}
+
+func (d *DirProvider) GetBuffer() (*TreeBuffer, error) {
+	d.lock.RLock()
+	buffer := d.buffer
+	d.lock.RUnlock()
+	if buffer == nil {
+		return d.loadDir()
+	}
+	return buffer, nil
+}
+
+func (d *DirProvider) Reload() (*TreeBuffer, error) {
+	return d.loadDir()
+}
+
+// poll the directory every interval until the ..data link or a file changed
+func (d *DirProvider) WaitChange(stop <-chan struct{}) (bool, error) {
+	ticker := time.NewTicker(d.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return false, nil
+		case <-ticker.C:
+		}
+		version, err := d.dirVersion()
+		if err != nil {
+			return false, err
+		}
+		d.lock.RLock()
+		changed := version != d.version
+		d.lock.RUnlock()
+		if changed {
+			return true, nil
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package configuration
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// lay out dir like a kubernetes configmap volume, the visible entries
+// link through the ..data symlink to a timestamped directory
+func writeK8sVolume(t *testing.T, dir, version string, files map[string]string) {
+	data := filepath.Join(dir, version)
+	for name, content := range files {
+		name = filepath.Join(data, name)
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tmp := filepath.Join(dir, "..data_tmp")
+	if err := os.Symlink(version, tmp); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, k8sDataLink)); err != nil {
+		t.Fatal(err)
+	}
+	fis, _ := ioutil.ReadDir(data)
+	for _, fi := range fis {
+		link := filepath.Join(dir, fi.Name())
+		if _, err := os.Lstat(link); err == nil {
+			continue
+		}
+		if err := os.Symlink(filepath.Join(k8sDataLink, fi.Name()), link); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDirProvider(t *testing.T) {
+	dir, err := ioutil.TempDir("", "configuration")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeK8sVolume(t, dir, "..2024_01_01", map[string]string{
+		"db.host":        "10.0.0.1\n",
+		"wx/oracle.port": "1521",
+		"wx/mp/appid":    "app",
+	})
+
+	p := NewDirProvider(dir)
+	p.Interval = 10 * time.Millisecond
+	b, err := p.GetBuffer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := b.GetString("db.host", ""); err != nil || v != "10.0.0.1" {
+		t.Fatal("dir value error", v, err)
+	}
+	if v, err := b.GetInt("wx.oracle.port", ""); err != nil || v != 1521 {
+		t.Fatal("dir nested value error", v, err)
+	}
+	if v, err := b.GetString("wx.mp.appid", ""); err != nil || v != "app" {
+		t.Fatal("dir nested value error", v, err)
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	changed := make(chan bool, 1)
+	go func() {
+		ok, _ := p.WaitChange(stop)
+		changed <- ok
+	}()
+	writeK8sVolume(t, dir, "..2024_01_02", map[string]string{
+		"db.host":        "10.0.0.2",
+		"wx/oracle.port": "1521",
+		"wx/mp/appid":    "app",
+	})
+	select {
+	case ok := <-changed:
+		if !ok {
+			t.Fatal("dir watch stopped")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("dir watch timeout")
+	}
+	if b, err = p.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := b.GetString("db.host", ""); v != "10.0.0.2" {
+		t.Fatal("dir reload value error", v)
+	}
+}
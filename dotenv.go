@@ -0,0 +1,165 @@
+package configuration
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+func init() {
+	RegisterProvider("dotenv", func(param string) (Provider, error) {
+		return NewDotenvProvider(param), nil
+	})
+	RegisterFormat("env", parseDotenv)
+}
+
+// .env file provider, keys are mapped like the env provider and
+// the process environment overrides the file. a value set in the file
+// isn't overridden by a XXX_FILE variable of the environment
+type DotenvProvider struct {
+	filename string
+	buffer   *TreeBuffer
+}
+
+func NewDotenvProvider(filename string) *DotenvProvider {
+	return &DotenvProvider{filename: filename}
+}
+
+func (d *DotenvProvider) loadDotenv() (*TreeBuffer, error) {
+	bts, err := ioutil.ReadFile(d.filename)
+	if err != nil {
+		return nil, err
+	}
+	pairs, err := parseDotenvPairs(string(bts))
+	if err != nil {
+		return nil, fmt.Errorf("%v [%s]", err, d.filename)
+	}
+	buffer := NewTreeBuffer()
+	buffer.SetOrigin(Origin{Provider: "dotenv", Source: d.filename})
+	setEnvs(buffer, pairs)
+	buffer.SetOrigin(Origin{})
+	envs := environ()
+	envBuffer := NewTreeBuffer()
+	setEnvs(envBuffer, envs)
+	for k := range pairs {
+		if _, ok := envs[k]; !ok {
+			if _, ok := envs[k+envFileSuffix]; ok {
+				envBuffer.Delete(k)
+			}
+		}
+	}
+	buffer.MergeFrom(envBuffer, true)
+	d.buffer = buffer
+	return d.buffer, nil
+}
+
+func (d *DotenvProvider) GetBuffer() (*TreeBuffer, error) {
+	if d.buffer == nil {
+		return d.loadDotenv()
+	}
+	return d.buffer, nil
+}
+
+// KEY=value lines with optional export, # comments,
+// 'single quoted' literal and "double quoted" escaped values
+func parseDotenv(buffer *TreeBuffer, data []byte) error {
+	envs, err := parseDotenvPairs(string(data))
+	if err != nil {
+		return err
+	}
+	setEnvs(buffer, envs)
+	return nil
+}
+
+func parseDotenvPairs(s string) (map[string]string, error) {
+	envs := make(map[string]string)
+	s = strings.Replace(s, "\r\n", "\n", -1)
+	line := 1
+	for len(s) > 0 {
+		var l string
+		if i := strings.IndexByte(s, '\n'); i >= 0 {
+			l, s = s[:i], s[i+1:]
+		} else {
+			l, s = s, ""
+		}
+		start := line
+		line++
+		l = strings.TrimSpace(l)
+		if len(l) == 0 || strings.HasPrefix(l, "#") {
+			continue
+		}
+		if strings.HasPrefix(l, "export ") {
+			l = strings.TrimSpace(l[len("export "):])
+		}
+		i := strings.IndexByte(l, '=')
+		if i <= 0 {
+			return nil, fmt.Errorf("dotenv line %d: missing = in %q", start, l)
+		}
+		k := strings.TrimSpace(l[:i])
+		v := strings.TrimSpace(l[i+1:])
+		if len(v) > 0 && (v[0] == '"' || v[0] == '\'') {
+			// quoted values may span lines
+			q := v[0]
+			for closingQuote(v, q) < 0 && len(s) > 0 {
+				var next string
+				if j := strings.IndexByte(s, '\n'); j >= 0 {
+					next, s = s[:j], s[j+1:]
+				} else {
+					next, s = s, ""
+				}
+				line++
+				v += "\n" + next
+			}
+			end := closingQuote(v, q)
+			if end < 0 {
+				return nil, fmt.Errorf("dotenv line %d: unterminated quote", start)
+			}
+			if rest := strings.TrimSpace(v[end+1:]); len(rest) > 0 && !strings.HasPrefix(rest, "#") {
+				return nil, fmt.Errorf("dotenv line %d: unexpected %q after quote", start, rest)
+			}
+			if q == '"' {
+				v = unescapeDotenv(v[1:end])
+			} else {
+				v = v[1:end]
+			}
+		} else if j := strings.Index(v, " #"); j >= 0 {
+			v = strings.TrimSpace(v[:j])
+		}
+		envs[k] = v
+	}
+	return envs, nil
+}
+
+// index of the quote closing v[0], -1 if it isn't closed
+func closingQuote(v string, q byte) int {
+	for i := 1; i < len(v); i++ {
+		if q == '"' && v[i] == '\\' {
+			i++
+		} else if v[i] == q {
+			return i
+		}
+	}
+	return -1
+}
+
+func unescapeDotenv(v string) string {
+	var b strings.Builder
+	for i := 0; i < len(v); i++ {
+		if v[i] != '\\' || i+1 == len(v) {
+			b.WriteByte(v[i])
+			continue
+		}
+		i++
+		switch v[i] {
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 't':
+			b.WriteByte('\t')
+		default:
+			b.WriteByte(v[i])
+		}
+	}
+	return b.String()
+}
@@ -3,35 +3,53 @@ package configuration
 import (
 	"fmt"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const DefaultProvider string = "file::./config.ini"
 
+// waits of Watch between failed attempts, doubled after every failure
+var (
+	watchRetryMin = time.Second
+	watchRetryMax = time.Minute
+)
+
 type Driver struct {
+	// type of the file and env schemes, CTUnkown for others.
+	//
+	// Deprecated: use Scheme
 	Type         ConfigType
+	Scheme       string
 	ContextParam string
 	Provider     Provider
-}
+	// last known good cache of the provider, see CachedProvider
+	CacheFile string
 
-var confTypeM = map[ConfigType]string{
-	CTFileConf: "file",
-	//CTEtcd:     "etcd",
-	CTEnv:      "env",
+	// current buffer of the provider, replaced on reload
+	buffer        atomic.Pointer[TreeBuffer]
+	listFormat    atomic.Pointer[ListFormat]
+	listeners     []*func(old, new *TreeBuffer)
+	watchErrors   []func(err error)
+	listenersLock sync.Mutex
 }
 
-// parse provider to config type and fetch provider's param
+// parse provider to scheme and fetch provider's param
 func (this *Driver) ParseProvider(provider string) (err error) {
-	this.Type = CTUnkown
-	for key, value := range confTypeM {
-		if strings.HasPrefix(provider, value+"::") {
-			this.Type = key
-			this.ContextParam = string(provider[len(value)+2:])
-			break
-		}
+	i := strings.Index(provider, "::")
+	if i < 0 {
+		return fmt.Errorf("Unkown configuration provinder [%s]", provider)
 	}
-	if this.Type == CTUnkown {
+	if _, ok := lookupProvider(string(provider[:i])); !ok {
 		return fmt.Errorf("Unkown configuration provinder [%s]", provider)
 	}
+	this.Scheme = string(provider[:i])
+	this.ContextParam = string(provider[i+2:])
+	this.Type = CTUnkown
+	if t, ok := confTypeM[this.Scheme]; ok {
+		this.Type = t
+	}
 	return
 }
 
@@ -41,25 +59,147 @@ func (this *Driver) LoadProvider() (Provider, error) {
 	if this.Provider != nil {
 		return this.Provider, nil
 	}
-	var err error = nil
-	if this.Type == CTFileConf {
-		this.Provider = NewFileProvider(this.ContextParam)
-	//} else if this.Type == CTEtcd {
-	//	this.Provider = NewEtcdProvider(this.ContextParam)
-	} else if this.Type == CTEnv {
-		this.Provider = NewEnvProvider()
-	} else {
+	factory, ok := lookupProvider(this.Scheme)
+	if !ok {
 		return nil, ErrUnkownProvider
 	}
-	return this.Provider, err
+	p, err := factory(this.ContextParam)
+	if err != nil {
+		return nil, err
+	}
+	if len(this.CacheFile) > 0 {
+		p = NewCachedProvider(p, this.CacheFile)
+	}
+	this.Provider = p
+	return this.Provider, nil
 }
 
 func (this *Driver) Buffer() *TreeBuffer {
+	if b := this.buffer.Load(); b != nil {
+		return b
+	}
 	b, err := this.Provider.GetBuffer()
 	if err != nil {
 		panic(err)
 	}
+	this.setBuffer(b)
 	return b
 }
 
+// set the list format of the current buffer and of the reloaded ones
+func (this *Driver) SetListFormat(f ListFormat) {
+	this.listFormat.Store(&f)
+	this.Buffer().SetListFormat(f)
+}
+
+func (this *Driver) setBuffer(b *TreeBuffer) {
+	if f := this.listFormat.Load(); f != nil {
+		b.SetListFormat(*f)
+	}
+	this.buffer.Store(b)
+}
+
+// reload provider's source and notify the change listeners
+func (this *Driver) Reload() error {
+	r, ok := this.Provider.(Reloader)
+	if !ok {
+		return ErrNotReloadable
+	}
+	old, _ := this.Provider.GetBuffer()
+	b, err := r.Reload()
+	if err != nil {
+		return err
+	}
+	this.setBuffer(b)
+	this.notify(old, b)
+	return nil
+}
+
+// reload every time the provider's source changes until stop is closed.
+// failed waits and reloads are passed to the OnWatchError listeners and
+// retried, waiting from 1s up to 1m between attempts, the current
+// buffer is kept meanwhile
+func (this *Driver) Watch(stop <-chan struct{}) error {
+	w, ok := this.Provider.(Watcher)
+	if !ok {
+		return ErrNotWatchable
+	}
+	if _, ok := this.Provider.(Reloader); !ok {
+		return ErrNotReloadable
+	}
+	retry := watchRetryMin
+	for {
+		changed, err := w.WaitChange(stop)
+		if err == nil && !changed {
+			return nil
+		}
+		if err == nil {
+			err = this.Reload()
+		}
+		if err == nil {
+			retry = watchRetryMin
+			continue
+		}
+		this.notifyWatchError(err)
+		select {
+		case <-stop:
+			return nil
+		case <-time.After(retry):
+		}
+		if retry *= 2; retry > watchRetryMax {
+			retry = watchRetryMax
+		}
+	}
+}
+
+// call fn with every error of Watch, Watch retries after it
+func (this *Driver) OnWatchError(fn func(err error)) {
+	this.listenersLock.Lock()
+	defer this.listenersLock.Unlock()
+	this.watchErrors = append(this.watchErrors, fn)
+}
+
+func (this *Driver) notifyWatchError(err error) {
+	this.listenersLock.Lock()
+	listeners := make([]func(err error), len(this.watchErrors))
+	copy(listeners, this.watchErrors)
+	this.listenersLock.Unlock()
+	for _, fn := range listeners {
+		fn(err)
+	}
+}
+
+// call fn after every reload
+func (this *Driver) OnChange(fn func(old, new *TreeBuffer)) {
+	this.onChange(fn)
+}
+
+// OnChange which returns the function removing fn
+func (this *Driver) onChange(fn func(old, new *TreeBuffer)) func() {
+	this.listenersLock.Lock()
+	defer this.listenersLock.Unlock()
+	p := &fn
+	this.listeners = append(this.listeners, p)
+	return func() {
+		this.listenersLock.Lock()
+		defer this.listenersLock.Unlock()
+		for i, l := range this.listeners {
+			if l == p {
+				this.listeners = append(this.listeners[:i:i], this.listeners[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+func (this *Driver) notify(old, new *TreeBuffer) {
+	this.listenersLock.Lock()
+	listeners := make([]*func(old, new *TreeBuffer), len(this.listeners))
+	copy(listeners, this.listeners)
+	this.listenersLock.Unlock()
+	for _, fn := range listeners {
+		(*fn)(old, new)
+	}
+}
+
 var driver *Driver
@@ -5,6 +5,15 @@ import (
 	"strings"
 )
 
+// suffix of environment variables naming a file that holds the value
+const envFileSuffix = "_FILE"
+
+func init() {
+	RegisterProvider("env", func(param string) (Provider, error) {
+		return NewEnvProvider(), nil
+	})
+}
+
 type EnvProvider struct {
 	buffer *TreeBuffer
 }
@@ -15,16 +24,50 @@ func NewEnvProvider() *EnvProvider {
 
 func (f *EnvProvider) loadEnv() *TreeBuffer {
 	f.buffer = NewTreeBuffer()
-	envs := os.Environ()
-	for _, env := range envs {
+	setEnvs(f.buffer, environ())
+	return f.buffer
+}
+
+// the process environment by variable name
+func environ() map[string]string {
+	envs := make(map[string]string)
+	for _, env := range os.Environ() {
 		kvs := strings.SplitN(env, "=", 2)
 		if len(kvs) == 2 {
-			f.buffer.Set(kvs[0], kvs[1])
+			envs[kvs[0]] = kvs[1]
 		} else {
-			f.buffer.Set(kvs[0], "")
+			envs[kvs[0]] = ""
+		}
+	}
+	return envs
+}
+
+// set environment variables as keys, DB_PASSWORD_FILE=/run/secrets/db_password
+// provides DB_PASSWORD with the file content, unless DB_PASSWORD itself is set.
+// names are split at dots and values set as they are, quotes of .env
+// values are already removed by the parser. without an origin set on
+// buffer the variables are the origins
+func setEnvs(buffer *TreeBuffer, envs map[string]string) {
+	origin := buffer.currentOrigin()
+	setEnv := func(k, v, env string) {
+		if len(origin.Provider) == 0 {
+			buffer.SetOrigin(Origin{Provider: "env", Source: env})
+			defer buffer.SetOrigin(origin)
+		}
+		buffer.SetIn(strings.Split(k, "."), v)
+	}
+	for k, v := range envs {
+		setEnv(k, v, k)
+	}
+	for k, v := range envs {
+		if !strings.HasSuffix(k, envFileSuffix) {
+			continue
+		}
+		k = strings.TrimSuffix(k, envFileSuffix)
+		if _, ok := envs[k]; !ok && len(k) > 0 {
+			setEnv(k, fileRefPrefix+v, k+envFileSuffix)
 		}
 	}
-	return f.buffer
 }
 
 func (f *EnvProvider) GetBuffer() (*TreeBuffer, error) {
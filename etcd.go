@@ -8,6 +8,12 @@ package configuration
 //	"time"
 //)
 //
+//func init() {
+//	RegisterProvider("etcd", func(param string) (Provider, error) {
+//		return NewEtcdProvider(param), nil
+//	})
+//}
+//
 //type EtcdProvider struct {
 //	host   string
 //	dir    string
@@ -1,42 +1,193 @@
 package configuration
 
 import (
+	"fmt"
 	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
 	"strings"
 )
 
+func init() {
+	RegisterProvider("file", func(param string) (Provider, error) {
+		name, profiles, err := fileParam(param)
+		if err != nil {
+			return nil, err
+		}
+		return NewFileProvider(name).withProfiles(profiles), nil
+	})
+	RegisterProvider("confd", func(param string) (Provider, error) {
+		dir, profiles, err := fileParam(param)
+		if err != nil {
+			return nil, err
+		}
+		return NewConfdProvider(dir).withProfiles(profiles), nil
+	})
+}
+
+// split the options after # of a file param, eg.
+// ./config.ini#profile=prod,cn-east. profiles is nil without the
+// profile option, the profiles of env APP_PROFILE are used then
+func fileParam(param string) (string, []string, error) {
+	i := strings.LastIndexByte(param, '#')
+	if i < 0 {
+		return param, nil, nil
+	}
+	opts, err := url.ParseQuery(param[i+1:])
+	if err != nil {
+		return "", nil, err
+	}
+	for k := range opts {
+		if k != "profile" {
+			return "", nil, fmt.Errorf("file provider option in error [%s]", k)
+		}
+	}
+	if _, ok := opts["profile"]; !ok {
+		return param[:i], nil, nil
+	}
+	return param[:i], append([]string{}, splitProfiles(opts.Get("profile"))...), nil
+}
+
+// file provider, the filename may be a glob pattern like
+// /etc/app/conf.d/*.ini, the matched files are loaded in lexical
+// order and later files override earlier ones.
+// with profiles, config.ini is overridden by its [profile:name]
+// sections and then by config.name.ini, in profile order
 type FileProvider struct {
 	filename string
+	profiles []string
 	buffer   *TreeBuffer
 }
 
+// profiles default to env APP_PROFILE
 func NewFileProvider(filename string) *FileProvider {
-	return &FileProvider{filename: filename}
+	return &FileProvider{filename: filename, profiles: envProfiles()}
 }
 
-func (f *FileProvider) loadFile() (*TreeBuffer, error) {
-	buffer := NewTreeBuffer()
-	bts, err := ioutil.ReadFile(f.filename)
+// use the profiles instead of env APP_PROFILE, later ones override earlier ones
+func (f *FileProvider) WithProfiles(profiles ...string) *FileProvider {
+	f.profiles = profiles
+	return f
+}
+
+// WithProfiles if profiles isn't nil
+func (f *FileProvider) withProfiles(profiles []string) *FileProvider {
+	if profiles != nil {
+		f.profiles = profiles
+	}
+	return f
+}
+
+// all files of the directory in lexical order, eg. 00-defaults.ini
+// overridden by 90-local.ini
+func NewConfdProvider(dir string) *FileProvider {
+	return NewFileProvider(filepath.Join(globEscape(dir), "*"))
+}
+
+// escape the pattern characters of the path for filepath.Glob
+func globEscape(path string) string {
+	var sb strings.Builder
+	for _, r := range path {
+		if strings.ContainsRune(`*?[\`, r) && os.PathSeparator != '\\' {
+			sb.WriteByte('\\')
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
+
+// whether the filename is a glob pattern, [ is only a pattern if no
+// file has the name, eg. /etc/app[1]/config.ini
+func isGlob(filename string) bool {
+	if strings.ContainsAny(filename, "*?") {
+		return true
+	}
+	if !strings.Contains(filename, "[") {
+		return false
+	}
+	_, err := os.Stat(filename)
+	return err != nil
+}
+
+// files to load, glob patterns skip hidden files and directories.
+// a pattern matching no files is empty, eg. an empty conf.d directory,
+// but its directory must exist
+func (f *FileProvider) files() ([]string, error) {
+	if !isGlob(f.filename) {
+		return []string{f.filename}, nil
+	}
+	matches, err := filepath.Glob(f.filename)
 	if err != nil {
 		return nil, err
 	}
-	lines := strings.Split(string(bts), "\n")
-	for _, l := range lines {
-		l = strings.TrimRight(l, "\r")
-		l = strings.TrimSpace(l)
-		if strings.HasPrefix(l, "#") {
+	// overlays of the active profiles are skipped here, loadFile loads
+	// them in profile order
+	all := make(map[string]bool, len(matches))
+	for _, name := range matches {
+		all[name] = true
+	}
+	names := make([]string, 0, len(matches))
+	for _, name := range matches {
+		if strings.HasPrefix(filepath.Base(name), ".") || isProfileFile(name, f.profiles, all) {
 			continue
 		}
-		if strings.HasPrefix(l, "[") && strings.HasSuffix(l, "]") {
+		if fi, err := os.Stat(name); err != nil || fi.IsDir() {
 			continue
 		}
-		kvs := strings.SplitN(l, "=", 2)
-		k := strings.ToLower(strings.TrimSpace(kvs[0]))
-		v := ""
-		if len(kvs) > 1 {
-			v = strings.TrimSpace(kvs[1])
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		dirs, _ := filepath.Glob(filepath.Dir(f.filename))
+		if len(dirs) == 0 || !strings.ContainsAny(f.filename, "*?") {
+			return nil, fmt.Errorf("no configuration file matches [%s]", f.filename)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (f *FileProvider) parseFile(buffer *TreeBuffer, name string) error {
+	bts, err := ioutil.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	buffer.SetOrigin(Origin{Provider: "file", Source: name})
+	defer buffer.SetOrigin(Origin{})
+	if err = formatOf(name)(buffer, bts); err != nil {
+		return fmt.Errorf("%v [%s]", err, name)
+	}
+	applyProfiles(buffer, f.profiles)
+	return nil
+}
+
+func (f *FileProvider) loadFile() (*TreeBuffer, error) {
+	buffer := NewTreeBuffer()
+	names, err := f.files()
+	if err != nil {
+		return nil, err
+	}
+	// files are merged so a list of a later file replaces the whole list
+	for _, name := range names {
+		fb := NewTreeBuffer()
+		if err = f.parseFile(fb, name); err != nil {
+			return nil, err
+		}
+		buffer.MergeFrom(fb, true)
+	}
+	for _, p := range f.profiles {
+		for _, name := range names {
+			name = profileFile(name, p)
+			if _, err := os.Stat(name); os.IsNotExist(err) {
+				continue
+			}
+			pb := NewTreeBuffer()
+			if err = f.parseFile(pb, name); err != nil {
+				return nil, err
+			}
+			buffer.MergeFrom(pb, true)
 		}
-		buffer.Set(k, v)
 	}
 	envBuffer, _ := NewEnvProvider().GetBuffer()
 	buffer.MergeFrom(envBuffer, false)
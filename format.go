@@ -0,0 +1,131 @@
+package configuration
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v2"
+)
+
+// parse the content of a config document into buffer
+type FormatParser func(buffer *TreeBuffer, data []byte) error
+
+var (
+	formats = map[string]FormatParser{
+		"ini":  parseINI,
+		"conf": parseINI,
+		"json": parseJSON,
+		"yaml": parseYAML,
+		"yml":  parseYAML,
+	}
+	formatsLock sync.RWMutex
+)
+
+// register a parser for documents with the format name or file extension,
+// eg. RegisterFormat("toml", parseTOML)
+func RegisterFormat(name string, parser FormatParser) {
+	formatsLock.Lock()
+	defer formatsLock.Unlock()
+	formats[strings.ToLower(name)] = parser
+}
+
+func lookupFormat(name string) (FormatParser, bool) {
+	formatsLock.RLock()
+	defer formatsLock.RUnlock()
+	parser, ok := formats[strings.ToLower(name)]
+	return parser, ok
+}
+
+// parser for the file name's extension, unknown extensions are ini
+func formatOf(filename string) FormatParser {
+	if parser, ok := lookupFormat(strings.TrimPrefix(path.Ext(filename), ".")); ok {
+		return parser
+	}
+	return parseINI
+}
+
+// key = value lines, # comments and [section] lines are ignored,
+// keys in a [profile:name] section are set under profileKey(name)
+func parseINI(buffer *TreeBuffer, data []byte) error {
+	lines := strings.Split(string(data), "\n")
+	profile := ""
+	for i, l := range lines {
+		l = strings.TrimRight(l, "\r")
+		l = strings.TrimSpace(l)
+		if strings.HasPrefix(l, "#") {
+			continue
+		}
+		if strings.HasPrefix(l, "[") && strings.HasSuffix(l, "]") {
+			profile = ""
+			if section := strings.TrimSpace(l[1 : len(l)-1]); strings.HasPrefix(section, profileSection) {
+				profile = profileKey(strings.TrimSpace(section[len(profileSection):]))
+			}
+			continue
+		}
+		kvs := strings.SplitN(l, "=", 2)
+		k := strings.TrimSpace(kvs[0])
+		if len(profile) > 0 && len(k) > 0 {
+			k = profile + "." + k
+		}
+		v := ""
+		if len(kvs) > 1 {
+			v = strings.TrimSpace(kvs[1])
+		}
+		buffer.setLine(i + 1)
+		buffer.Set(k, v)
+	}
+	return nil
+}
+
+func parseJSON(buffer *TreeBuffer, data []byte) error {
+	var v interface{}
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	if err := d.Decode(&v); err != nil {
+		return err
+	}
+	setNested(buffer, nil, v)
+	return nil
+}
+
+func parseYAML(buffer *TreeBuffer, data []byte) error {
+	var v interface{}
+	if err := yaml.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	setNested(buffer, nil, v)
+	return nil
+}
+
+// set decoded json or yaml values, objects become children and
+// arrays become indexed children (key.0, key.1, ...)
+func setNested(buffer *TreeBuffer, ks []string, v interface{}) {
+	child := func(k string) []string {
+		cks := make([]string, len(ks), len(ks)+1)
+		copy(cks, ks)
+		return append(cks, k)
+	}
+	switch vv := v.(type) {
+	case map[string]interface{}:
+		for k, c := range vv {
+			setNested(buffer, child(k), c)
+		}
+	case map[interface{}]interface{}:
+		for k, c := range vv {
+			setNested(buffer, child(fmt.Sprint(k)), c)
+		}
+	case []interface{}:
+		for i, c := range vv {
+			setNested(buffer, child(strconv.Itoa(i)), c)
+		}
+	case nil:
+		buffer.SetIn(ks, "")
+	default:
+		buffer.SetIn(ks, fmt.Sprint(vv))
+	}
+}
@@ -0,0 +1,79 @@
+package configuration
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// get config value of key as T, converted like the fields of Var:
+// primitives, time.Duration, slices, maps, structs and types
+// implementing encoding.TextUnmarshaler, eg. Get[[]int]("wx.ports")
+func Get[T any](key string) (T, error) {
+	loadDriver()
+	return GetFrom[T](driver.Buffer(), key)
+}
+
+// config value of key as T, fallback if it is missing. values which
+// can't be converted are errors, port = 80x isn't the fallback
+func GetOr[T any](key string, fallback T) (T, error) {
+	loadDriver()
+	return GetOrFrom(driver.Buffer(), key, fallback)
+}
+
+// config value of key as T, panic if it is missing or can't be converted
+func MustGet[T any](key string) T {
+	v, err := Get[T](key)
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
+
+// value of key in buffer as T, see Get
+func GetFrom[T any](b *TreeBuffer, key string) (T, error) {
+	var v T
+	t := reflect.TypeOf(&v).Elem()
+	if t.Kind() == reflect.Interface {
+		return v, NewBufferError(errType, key)
+	}
+	ks, berr := lookupKey(key)
+	if berr != nil {
+		return v, berr
+	}
+	// a struct with one field tagged with key, so the value is set
+	// exactly like a field of Var
+	st := reflect.StructOf([]reflect.StructField{{
+		Name: "V",
+		Type: t,
+		Tag:  reflect.StructTag(fmt.Sprintf("conf:%v", strconv.Quote(tagKey(ks)))),
+	}})
+	sv := reflect.New(st).Elem()
+	if berr := b.varSet(st, sv, ""); berr != nil {
+		return v, berr
+	}
+	return sv.Field(0).Interface().(T), nil
+}
+
+// value of key in buffer as T, fallback if it is missing, see GetOr
+func GetOrFrom[T any](b *TreeBuffer, key string, fallback T) (T, error) {
+	v, err := GetFrom[T](b, key)
+	if be, ok := err.(*BufferError); ok && IsKeyNotFound(be) {
+		return fallback, nil
+	}
+	return v, err
+}
+
+// key path of the segments for a conf tag, every segment is quoted so
+// commas and parentheses aren't taken as tag options
+func tagKey(ks []string) string {
+	qks := make([]string, len(ks))
+	for i, k := range ks {
+		qks[i] = JoinKey(k)
+		if qks[i] == k {
+			qks[i] = `"` + k + `"`
+		}
+	}
+	return strings.Join(qks, ".")
+}
@@ -0,0 +1,392 @@
+package configuration
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+func init() {
+	RegisterFormat("hcl", parseHCL)
+}
+
+// hcl2 native syntax without expressions: attributes, blocks with
+// labels, strings, heredocs, numbers, bools, null, tuples and objects.
+// labeled blocks nest by their labels, server "api" { port = 80 } is
+// server.api.port, repeated unlabeled blocks become indexed children
+func parseHCL(buffer *TreeBuffer, data []byte) error {
+	p := &hclParser{src: []rune(string(data)), line: 1}
+	m, err := p.body(false)
+	if err != nil {
+		return err
+	}
+	setNested(buffer, nil, m)
+	return nil
+}
+
+type hclParser struct {
+	src  []rune
+	pos  int
+	line int
+}
+
+func (p *hclParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("hcl line %d: %s", p.line, fmt.Sprintf(format, args...))
+}
+
+func (p *hclParser) peek() rune {
+	if p.pos >= len(p.src) {
+		return 0
+	}
+	return p.src[p.pos]
+}
+
+func (p *hclParser) next() rune {
+	r := p.peek()
+	if r == '\n' {
+		p.line++
+	}
+	p.pos++
+	return r
+}
+
+// skip spaces and comments, newlines too if nl is set
+func (p *hclParser) skip(nl bool) {
+	for p.pos < len(p.src) {
+		r := p.peek()
+		switch {
+		case r == '\n' && nl, r == ' ', r == '\t', r == '\r':
+			p.next()
+		case r == '#' || r == '/' && p.pos+1 < len(p.src) && p.src[p.pos+1] == '/':
+			for p.pos < len(p.src) && p.peek() != '\n' {
+				p.next()
+			}
+		case r == '/' && p.pos+1 < len(p.src) && p.src[p.pos+1] == '*':
+			p.next()
+			p.next()
+			for p.pos < len(p.src) && !(p.peek() == '*' && p.pos+1 < len(p.src) && p.src[p.pos+1] == '/') {
+				p.next()
+			}
+			p.next()
+			p.next()
+		default:
+			return
+		}
+	}
+}
+
+func isHCLIdent(r rune, first bool) bool {
+	return r == '_' || unicode.IsLetter(r) || !first && (r == '-' || unicode.IsDigit(r))
+}
+
+func (p *hclParser) ident() string {
+	start := p.pos
+	for p.pos < len(p.src) && isHCLIdent(p.peek(), p.pos == start) {
+		p.next()
+	}
+	return string(p.src[start:p.pos])
+}
+
+// attributes and blocks until eof or the closing brace of a block
+func (p *hclParser) body(block bool) (map[string]interface{}, error) {
+	m := make(map[string]interface{})
+	// unlabeled blocks by type, more than one becomes a list
+	unlabeled := make(map[string][]interface{})
+	var order []string
+	for {
+		p.skip(true)
+		r := p.peek()
+		if r == 0 {
+			if block {
+				return nil, p.errorf("missing closing brace")
+			}
+			break
+		}
+		if r == '}' {
+			if !block {
+				return nil, p.errorf("unexpected closing brace")
+			}
+			p.next()
+			break
+		}
+		name := p.ident()
+		if len(name) == 0 {
+			return nil, p.errorf("unexpected %q", r)
+		}
+		p.skip(false)
+		if p.peek() == '=' {
+			p.next()
+			v, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			if err = p.endOfItem(); err != nil {
+				return nil, err
+			}
+			m[name] = v
+			continue
+		}
+		var labels []string
+		for p.peek() != '{' {
+			switch {
+			case p.peek() == '"':
+				l, err := p.str()
+				if err != nil {
+					return nil, err
+				}
+				labels = append(labels, l)
+			case isHCLIdent(p.peek(), true):
+				labels = append(labels, p.ident())
+			default:
+				return nil, p.errorf("expected = or block after %q", name)
+			}
+			p.skip(false)
+		}
+		p.next()
+		b, err := p.body(true)
+		if err != nil {
+			return nil, err
+		}
+		if err = p.endOfItem(); err != nil {
+			return nil, err
+		}
+		if len(labels) == 0 {
+			if _, ok := unlabeled[name]; !ok {
+				order = append(order, name)
+			}
+			unlabeled[name] = append(unlabeled[name], b)
+			continue
+		}
+		parent := m
+		for _, k := range append([]string{name}, labels[:len(labels)-1]...) {
+			c, ok := parent[k].(map[string]interface{})
+			if !ok {
+				c = make(map[string]interface{})
+				parent[k] = c
+			}
+			parent = c
+		}
+		parent[labels[len(labels)-1]] = b
+	}
+	for _, name := range order {
+		if bs := unlabeled[name]; len(bs) == 1 {
+			m[name] = bs[0]
+		} else {
+			m[name] = bs
+		}
+	}
+	return m, nil
+}
+
+// an attribute or block ends with a newline, eof or closing brace
+func (p *hclParser) endOfItem() error {
+	p.skip(false)
+	switch p.peek() {
+	case '\n':
+		p.next()
+		return nil
+	case 0, '}':
+		return nil
+	}
+	return p.errorf("unexpected %q", p.peek())
+}
+
+func (p *hclParser) expr() (interface{}, error) {
+	p.skip(false)
+	r := p.peek()
+	switch {
+	case r == '"':
+		return p.str()
+	case r == '<' && p.pos+1 < len(p.src) && p.src[p.pos+1] == '<':
+		return p.heredoc()
+	case r == '[':
+		return p.tuple()
+	case r == '{':
+		return p.object()
+	case r == '-' || unicode.IsDigit(r):
+		return p.number()
+	case isHCLIdent(r, true):
+		switch id := p.ident(); id {
+		case "true", "false":
+			return id, nil
+		case "null":
+			return nil, nil
+		default:
+			return nil, p.errorf("unsupported expression %q", id)
+		}
+	}
+	return nil, p.errorf("unexpected %q", r)
+}
+
+func (p *hclParser) str() (string, error) {
+	p.next()
+	var b strings.Builder
+	for {
+		r := p.next()
+		switch r {
+		case 0, '\n':
+			return "", p.errorf("unterminated string")
+		case '"':
+			return b.String(), nil
+		case '\\':
+			switch e := p.next(); e {
+			case 'n':
+				b.WriteRune('\n')
+			case 'r':
+				b.WriteRune('\r')
+			case 't':
+				b.WriteRune('\t')
+			case '"', '\\':
+				b.WriteRune(e)
+			case 'u', 'U':
+				n := 4
+				if e == 'U' {
+					n = 8
+				}
+				if p.pos+n > len(p.src) {
+					return "", p.errorf("malformed \\%c escape", e)
+				}
+				c, err := strconv.ParseUint(string(p.src[p.pos:p.pos+n]), 16, 32)
+				if err != nil {
+					return "", p.errorf("malformed \\%c escape", e)
+				}
+				p.pos += n
+				b.WriteRune(rune(c))
+			default:
+				return "", p.errorf("unknown escape \\%c", e)
+			}
+		default:
+			b.WriteRune(r)
+		}
+	}
+}
+
+// <<EOF or the indented <<-EOF heredoc
+func (p *hclParser) heredoc() (string, error) {
+	p.pos += 2
+	indent := p.peek() == '-'
+	if indent {
+		p.next()
+	}
+	marker := p.ident()
+	if len(marker) == 0 || p.peek() != '\n' {
+		return "", p.errorf("malformed heredoc")
+	}
+	p.next()
+	var lines []string
+	for {
+		if p.pos >= len(p.src) {
+			return "", p.errorf("unterminated heredoc %s", marker)
+		}
+		start := p.pos
+		for p.pos < len(p.src) && p.peek() != '\n' {
+			p.next()
+		}
+		l := string(p.src[start:p.pos])
+		if strings.TrimSpace(l) == marker {
+			break
+		}
+		lines = append(lines, l)
+		p.next()
+	}
+	if indent {
+		// remove the smallest indentation of non blank lines
+		min := -1
+		for _, l := range lines {
+			if len(strings.TrimSpace(l)) == 0 {
+				continue
+			}
+			if n := len(l) - len(strings.TrimLeft(l, " \t")); min < 0 || n < min {
+				min = n
+			}
+		}
+		for i, l := range lines {
+			if len(l) >= min && min > 0 {
+				lines[i] = l[min:]
+			}
+		}
+	}
+	return strings.Join(lines, "\n") + "\n", nil
+}
+
+func (p *hclParser) number() (string, error) {
+	start := p.pos
+	if p.peek() == '-' {
+		p.next()
+	}
+	for p.pos < len(p.src) && strings.ContainsRune("0123456789.eE+-", p.peek()) {
+		if (p.peek() == '+' || p.peek() == '-') && !strings.ContainsRune("eE", p.src[p.pos-1]) {
+			break
+		}
+		p.next()
+	}
+	n := string(p.src[start:p.pos])
+	if _, err := strconv.ParseFloat(n, 64); err != nil {
+		return "", p.errorf("malformed number %q", n)
+	}
+	return n, nil
+}
+
+func (p *hclParser) tuple() ([]interface{}, error) {
+	p.next()
+	var vs []interface{}
+	for {
+		p.skip(true)
+		if p.peek() == ']' {
+			p.next()
+			return vs, nil
+		}
+		v, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		vs = append(vs, v)
+		p.skip(true)
+		switch p.peek() {
+		case ',':
+			p.next()
+		case ']':
+		default:
+			return nil, p.errorf("expected , or ] in tuple")
+		}
+	}
+}
+
+func (p *hclParser) object() (map[string]interface{}, error) {
+	p.next()
+	m := make(map[string]interface{})
+	for {
+		p.skip(true)
+		if p.peek() == '}' {
+			p.next()
+			return m, nil
+		}
+		var (
+			k   string
+			err error
+		)
+		if p.peek() == '"' {
+			if k, err = p.str(); err != nil {
+				return nil, err
+			}
+		} else if k = p.ident(); len(k) == 0 {
+			return nil, p.errorf("expected object key")
+		}
+		p.skip(false)
+		if r := p.next(); r != '=' && r != ':' {
+			return nil, p.errorf("expected = or : after object key %q", k)
+		}
+		if m[k], err = p.expr(); err != nil {
+			return nil, err
+		}
+		p.skip(false)
+		switch p.peek() {
+		case ',', '\n':
+			p.next()
+		case '}':
+		default:
+			return nil, p.errorf("expected , or } in object")
+		}
+	}
+}
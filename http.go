@@ -0,0 +1,260 @@
+package configuration
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	RegisterProvider("http", func(param string) (Provider, error) {
+		return NewHTTPProvider(param)
+	})
+}
+
+const (
+	defaultHTTPTimeout  = 10 * time.Second
+	defaultHTTPInterval = 30 * time.Second
+	defaultHTTPMaxSize  = 10 << 20
+)
+
+// remote config document provider, param eg.
+// https://config.internal/app.json#token=xxx&timeout=5s&interval=30s&max=1048576&header=X-Env:prod
+// options are in the url fragment which is never sent to the server:
+// token is a bearer token, header may repeat, interval is the polling
+// period of WaitChange, max is the response size limit in bytes and
+// format overrides the format guessed from the extension or content type
+type HTTPProvider struct {
+	URL      string
+	Header   http.Header
+	Timeout  time.Duration
+	Interval time.Duration
+	MaxSize  int64
+	Format   string
+
+	client *http.Client
+	etag   string
+	body   []byte
+	buffer *TreeBuffer
+	// document fetched by WaitChange, loaded by the next Reload
+	next *httpDocument
+	lock sync.RWMutex
+}
+
+type httpDocument struct {
+	body        []byte
+	etag        string
+	contentType string
+}
+
+func NewHTTPProvider(cp string) (*HTTPProvider, error) {
+	u, err := url.Parse(cp)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("http provider url in error [%s]", cp)
+	}
+	opts, err := url.ParseQuery(u.Fragment)
+	if err != nil {
+		return nil, err
+	}
+	u.Fragment = ""
+	h := &HTTPProvider{
+		URL:      u.String(),
+		Header:   http.Header{},
+		Timeout:  defaultHTTPTimeout,
+		Interval: defaultHTTPInterval,
+		MaxSize:  defaultHTTPMaxSize,
+		Format:   opts.Get("format"),
+	}
+	if token := opts.Get("token"); len(token) > 0 {
+		h.Header.Set("Authorization", "Bearer "+token)
+	}
+	for _, header := range opts["header"] {
+		kvs := strings.SplitN(header, ":", 2)
+		if len(kvs) < 2 {
+			return nil, fmt.Errorf("http provider header in error [%s]", header)
+		}
+		h.Header.Add(strings.TrimSpace(kvs[0]), strings.TrimSpace(kvs[1]))
+	}
+	if s := opts.Get("timeout"); len(s) > 0 {
+		if h.Timeout, err = time.ParseDuration(s); err != nil {
+			return nil, err
+		}
+	}
+	if s := opts.Get("interval"); len(s) > 0 {
+		if h.Interval, err = time.ParseDuration(s); err != nil {
+			return nil, err
+		}
+	}
+	if s := opts.Get("max"); len(s) > 0 {
+		if h.MaxSize, err = strconv.ParseInt(s, 10, 64); err != nil {
+			return nil, err
+		}
+	}
+	if _, ok := lookupFormat(h.Format); len(h.Format) > 0 && !ok {
+		return nil, fmt.Errorf("http provider format in error [%s]", h.Format)
+	}
+	return h, nil
+}
+
+// fetch the document, with etag it's a conditional request and
+// a nil body is returned if the document isn't modified
+func (h *HTTPProvider) fetch(etag string) (body []byte, newEtag, contentType string, err error) {
+	req, err := http.NewRequest("GET", h.URL, nil)
+	if err != nil {
+		return nil, "", "", err
+	}
+	for k, vs := range h.Header {
+		req.Header[k] = vs
+	}
+	if len(etag) > 0 {
+		req.Header.Set("If-None-Match", etag)
+	}
+	h.lock.Lock()
+	if h.client == nil {
+		h.client = &http.Client{Timeout: h.Timeout}
+	}
+	client := h.client
+	h.lock.Unlock()
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, "", "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, etag, "", nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", "", fmt.Errorf("http provider response status %v", resp.Status)
+	}
+	if resp.ContentLength > h.MaxSize {
+		return nil, "", "", fmt.Errorf("http provider response exceeds %v bytes", h.MaxSize)
+	}
+	body, err = ioutil.ReadAll(io.LimitReader(resp.Body, h.MaxSize+1))
+	if err != nil {
+		return nil, "", "", err
+	}
+	if int64(len(body)) > h.MaxSize {
+		return nil, "", "", fmt.Errorf("http provider response exceeds %v bytes", h.MaxSize)
+	}
+	return body, resp.Header.Get("ETag"), resp.Header.Get("Content-Type"), nil
+}
+
+// parser by the format option, url extension or content type
+func (h *HTTPProvider) parser(contentType string) (FormatParser, error) {
+	if len(h.Format) > 0 {
+		if parser, ok := lookupFormat(h.Format); ok {
+			return parser, nil
+		}
+		return nil, fmt.Errorf("http provider format in error [%s]", h.Format)
+	}
+	u, _ := url.Parse(h.URL)
+	if parser, ok := lookupFormat(strings.TrimPrefix(path.Ext(u.Path), ".")); ok {
+		return parser, nil
+	}
+	mt, _, _ := mime.ParseMediaType(contentType)
+	if i := strings.LastIndexAny(mt, "/+"); i >= 0 {
+		if parser, ok := lookupFormat(string(mt[i+1:])); ok {
+			return parser, nil
+		}
+	}
+	return parseINI, nil
+}
+
+// load the document found by WaitChange, fetch it if there is none
+func (h *HTTPProvider) loadHTTP() (*TreeBuffer, error) {
+	h.lock.Lock()
+	doc := h.next
+	h.next = nil
+	h.lock.Unlock()
+	if doc == nil {
+		body, etag, contentType, err := h.fetch("")
+		if err != nil {
+			return nil, err
+		}
+		doc = &httpDocument{body, etag, contentType}
+	}
+	body, etag := doc.body, doc.etag
+	parser, err := h.parser(doc.contentType)
+	if err != nil {
+		return nil, err
+	}
+	buffer := NewTreeBuffer()
+	source := h.URL
+	if u, err := url.Parse(h.URL); err == nil {
+		source = u.Redacted()
+	}
+	buffer.SetOrigin(Origin{Provider: "http", Source: source})
+	if err = parser(buffer, body); err != nil {
+		return nil, err
+	}
+	buffer.SetOrigin(Origin{})
+	envBuffer, _ := NewEnvProvider().GetBuffer()
+	buffer.MergeFrom(envBuffer, false)
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.buffer = buffer
+	h.etag = etag
+	h.body = body
+	return buffer, nil
+}
+
+func (h *HTTPProvider) GetBuffer() (*TreeBuffer, error) {
+	h.lock.RLock()
+	buffer := h.buffer
+	h.lock.RUnlock()
+	if buffer == nil {
+		return h.loadHTTP()
+	}
+	return buffer, nil
+}
+
+func (h *HTTPProvider) Reload() (*TreeBuffer, error) {
+	return h.loadHTTP()
+}
+
+// poll the document every interval with If-None-Match, servers without
+// etag are compared by content. a new etag of the same content is kept
+// for the next polls, a changed document is kept for Reload
+func (h *HTTPProvider) WaitChange(stop <-chan struct{}) (bool, error) {
+	ticker := time.NewTicker(h.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return false, nil
+		case <-ticker.C:
+		}
+		h.lock.RLock()
+		etag, last := h.etag, h.body
+		h.lock.RUnlock()
+		body, newEtag, contentType, err := h.fetch(etag)
+		if err != nil {
+			return false, err
+		}
+		if body == nil {
+			continue
+		}
+		h.lock.Lock()
+		if !bytes.Equal(body, last) {
+			h.next = &httpDocument{body, newEtag, contentType}
+			h.lock.Unlock()
+			return true, nil
+		}
+		if h.etag == etag {
+			h.etag = newEtag
+		}
+		h.lock.Unlock()
+	}
+}
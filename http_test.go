@@ -0,0 +1,184 @@
+package configuration
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHTTPProvider(t *testing.T) {
+	var (
+		lock    sync.Mutex
+		version = 1
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer t0k" || r.Header.Get("X-Env") != "prod" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		lock.Lock()
+		v := version
+		lock.Unlock()
+		etag := fmt.Sprintf(`"v%d"`, v)
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		switch r.URL.Path {
+		case "/app.json":
+			fmt.Fprintf(w, `{"wx": {"oracle": {"host": "db%d", "port": 1521}}, "servers": [{"name": "a"}, {"name": "b"}]}`, v)
+		case "/app.yaml":
+			fmt.Fprintf(w, "wx:\n  oracle:\n    host: db%d\n    ports: [1, 2]\n", v)
+		case "/app":
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			fmt.Fprint(w, `{"format": "json"}`)
+		case "/big.ini":
+			fmt.Fprint(w, strings.Repeat("a = b\n", 100))
+		}
+	}))
+	defer ts.Close()
+	opts := "#token=t0k&header=X-Env:prod&interval=10ms"
+
+	p, err := NewHTTPProvider(ts.URL + "/app.json" + opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := p.GetBuffer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := b.GetString("wx.oracle.host", ""); err != nil || v != "db1" {
+		t.Fatal("http json value error", v, err)
+	}
+	if v, err := b.GetString("servers.1.name", ""); err != nil || v != "b" {
+		t.Fatal("http json array error", v, err)
+	}
+
+	y, _ := NewHTTPProvider(ts.URL + "/app.yaml" + opts)
+	if b, err := y.GetBuffer(); err != nil {
+		t.Fatal(err)
+	} else if v, err := b.GetInts("wx.oracle.ports", ""); err != nil || len(v) != 2 || v[1] != 2 {
+		t.Fatal("http yaml value error", v, err)
+	}
+
+	c, _ := NewHTTPProvider(ts.URL + "/app" + opts)
+	if b, err := c.GetBuffer(); err != nil {
+		t.Fatal(err)
+	} else if v, _ := b.GetString("format", ""); v != "json" {
+		t.Fatal("http content type format error", v)
+	}
+
+	big, _ := NewHTTPProvider(ts.URL + "/big.ini" + opts + "&max=100")
+	if _, err := big.GetBuffer(); err == nil {
+		t.Fatal("http response size limit ignored")
+	}
+
+	noauth, _ := NewHTTPProvider(ts.URL + "/app.json")
+	if _, err := noauth.GetBuffer(); err == nil {
+		t.Fatal("http unauthorized response accepted")
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	changed := make(chan bool, 1)
+	go func() {
+		ok, _ := p.WaitChange(stop)
+		changed <- ok
+	}()
+	time.Sleep(50 * time.Millisecond)
+	lock.Lock()
+	version = 2
+	lock.Unlock()
+	select {
+	case ok := <-changed:
+		if !ok {
+			t.Fatal("http watch stopped")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("http watch timeout")
+	}
+	if b, err := p.Reload(); err != nil {
+		t.Fatal(err)
+	} else if v, _ := b.GetString("wx.oracle.host", ""); v != "db2" {
+		t.Fatal("http reload value error", v)
+	}
+}
+
+func TestHTTPWatchEtag(t *testing.T) {
+	var (
+		lock    sync.Mutex
+		etag    = `"a"`
+		body    = "host = db1\n"
+		fetches int
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		fetches++
+		w.Header().Set("ETag", etag)
+		fmt.Fprint(w, body)
+	}))
+	defer ts.Close()
+	p, err := NewHTTPProvider(ts.URL + "/app.ini#interval=10ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.GetBuffer(); err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	changed := make(chan bool, 1)
+	go func() {
+		ok, _ := p.WaitChange(stop)
+		changed <- ok
+	}()
+	// only the etag changes, it's fetched once and kept for the next polls
+	lock.Lock()
+	etag = `"b"`
+	lock.Unlock()
+	time.Sleep(100 * time.Millisecond)
+	lock.Lock()
+	if fetches != 2 {
+		t.Fatal("http etag not kept", fetches)
+	}
+	etag, body = `"c"`, "host = db2\n"
+	lock.Unlock()
+	select {
+	case <-changed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("http watch timeout")
+	}
+	b, err := p.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := b.GetString("host", ""); v != "db2" {
+		t.Fatal("http reload value error", v)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if fetches != 3 {
+		t.Fatal("http reload fetched the change again", fetches)
+	}
+}
+
+func TestHTTPFormat(t *testing.T) {
+	if _, err := NewHTTPProvider("http://localhost/app#format=toml"); err == nil {
+		t.Fatal("unknown format should fail")
+	}
+	p, _ := NewHTTPProvider("http://localhost/app")
+	p.Format = "toml"
+	if _, err := p.parser(""); err == nil {
+		t.Fatal("unknown format should fail")
+	}
+}
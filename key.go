@@ -0,0 +1,95 @@
+package configuration
+
+import (
+	"errors"
+	"strings"
+)
+
+var errKeyPath = errors.New("cann't parse the key path")
+
+// split a key path into segments. segments are separated by dots,
+// "quoted segments" may contain dots, \ escapes the next character
+// and [n] is an index segment, eg. wx."a.b".servers[0].host is
+// wx, a.b, servers, 0, host
+func ParseKey(key string) ([]string, error) {
+	var (
+		ks  []string
+		seg strings.Builder
+		// the current segment has content or quotes
+		started bool
+		// the last segment was an index, a following dot doesn't end a segment
+		indexed bool
+	)
+	for i := 0; i < len(key); {
+		switch c := key[i]; c {
+		case '.':
+			if !indexed || started {
+				ks = append(ks, seg.String())
+				seg.Reset()
+			}
+			started, indexed = false, false
+			i++
+		case '\\':
+			if i+1 == len(key) {
+				return nil, errKeyPath
+			}
+			seg.WriteByte(key[i+1])
+			started = true
+			i += 2
+		case '"':
+			j := i + 1
+			for ; j < len(key) && key[j] != '"'; j++ {
+				if key[j] == '\\' && j+1 < len(key) {
+					j++
+				}
+				seg.WriteByte(key[j])
+			}
+			if j >= len(key) {
+				return nil, errKeyPath
+			}
+			started = true
+			i = j + 1
+		case '[':
+			j := strings.IndexByte(key[i:], ']')
+			if j < 0 {
+				return nil, errKeyPath
+			}
+			if started {
+				ks = append(ks, seg.String())
+				seg.Reset()
+			}
+			ks = append(ks, key[i+1:i+j])
+			started, indexed = false, true
+			i += j + 1
+		default:
+			seg.WriteByte(c)
+			started = true
+			i++
+		}
+	}
+	if !indexed || started {
+		ks = append(ks, seg.String())
+	}
+	return ks, nil
+}
+
+// key path of the segments, segments with special characters are quoted
+func JoinKey(ks ...string) string {
+	qks := make([]string, len(ks))
+	for i, k := range ks {
+		if strings.ContainsAny(k, `."\[]`) {
+			k = `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(k) + `"`
+		}
+		qks[i] = k
+	}
+	return strings.Join(qks, ".")
+}
+
+// lower case segments of the key path for lookups
+func lookupKey(key string) ([]string, *BufferError) {
+	ks, err := ParseKey(strings.ToLower(key))
+	if err != nil {
+		return nil, NewBufferError(err, key)
+	}
+	return ks, nil
+}
@@ -0,0 +1,149 @@
+package configuration
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+)
+
+const defaultListSep = ";"
+
+// how list values are split into elements. values like ["a;b","c"] are
+// json arrays, otherwise elements are separated by Sep and may be
+// quoted csv style, "a;b";"say ""hi""" is a;b and say "hi". values whose
+// quotes don't parse like "a;b are split at Sep only
+type ListFormat struct {
+	// element separator, ";" if empty
+	Sep string
+	// trim whitespace around unquoted elements
+	Trim bool
+}
+
+// set the list format of the slice getters and of Var fields without a
+// sep option, eg. b.SetListFormat(ListFormat{Sep: ",", Trim: true})
+func (t *TreeBuffer) SetListFormat(f ListFormat) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.listFormat = f
+}
+
+func (t *TreeBuffer) currentListFormat() ListFormat {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.listFormat
+}
+
+// split the list value into its elements
+func (f ListFormat) Split(v string) []string {
+	if ss, ok := splitJSONList(v); ok {
+		return ss
+	}
+	sep := f.Sep
+	if len(sep) == 0 {
+		sep = defaultListSep
+	}
+	if ss, ok := f.splitQuoted(v, sep); ok {
+		return ss
+	}
+	ss := strings.Split(v, sep)
+	if f.Trim {
+		for i := range ss {
+			ss[i] = strings.TrimSpace(ss[i])
+		}
+	}
+	return ss
+}
+
+// elements of csv style quoted values, false if a quote isn't closed
+// or followed by text
+func (f ListFormat) splitQuoted(v, sep string) ([]string, bool) {
+	var (
+		ss []string
+		b  strings.Builder
+	)
+	for i := 0; ; {
+		// an element is quoted if it starts with ", spaces before the
+		// quote are only skipped when trimming
+		start := i
+		if f.Trim {
+			for start < len(v) && (v[start] == ' ' || v[start] == '\t') {
+				start++
+			}
+		}
+		quoted := start < len(v) && v[start] == '"'
+		if quoted {
+			i = start + 1
+			closed := false
+			for i < len(v) {
+				if v[i] == '"' {
+					if i+1 < len(v) && v[i+1] == '"' {
+						b.WriteByte('"')
+						i += 2
+						continue
+					}
+					closed = true
+					i++
+					break
+				}
+				b.WriteByte(v[i])
+				i++
+			}
+			if !closed {
+				return nil, false
+			}
+		}
+		end := strings.Index(v[i:], sep)
+		if end < 0 {
+			end = len(v)
+		} else {
+			end += i
+		}
+		if quoted {
+			// text after the closing quote, only spaces are expected
+			if rest := v[i:end]; strings.TrimSpace(rest) != "" {
+				return nil, false
+			}
+		} else {
+			e := v[i:end]
+			if f.Trim {
+				e = strings.TrimSpace(e)
+			}
+			b.WriteString(e)
+		}
+		ss = append(ss, b.String())
+		b.Reset()
+		if end == len(v) {
+			return ss, true
+		}
+		i = end + len(sep)
+	}
+}
+
+// elements of a json array literal, strings are taken as is and
+// other values as their json text, null is the empty string
+func splitJSONList(v string) ([]string, bool) {
+	v = strings.TrimSpace(v)
+	if !strings.HasPrefix(v, "[") || !strings.HasSuffix(v, "]") {
+		return nil, false
+	}
+	var vs []json.RawMessage
+	if err := json.Unmarshal([]byte(v), &vs); err != nil {
+		return nil, false
+	}
+	ss := make([]string, len(vs))
+	for i, raw := range vs {
+		raw = bytes.TrimSpace(raw)
+		var s string
+		switch {
+		case bytes.Equal(raw, []byte("null")):
+		case len(raw) > 0 && raw[0] == '"':
+			if err := json.Unmarshal(raw, &s); err != nil {
+				return nil, false
+			}
+		default:
+			s = string(raw)
+		}
+		ss[i] = s
+	}
+	return ss, true
+}
@@ -0,0 +1,126 @@
+package configuration
+
+import (
+	"fmt"
+	"strings"
+)
+
+// where a value came from
+type Origin struct {
+	// provider scheme, eg. file, env, consul
+	Provider string
+	// file path, url or key of the value in the provider, the
+	// variable name for env
+	Source string
+	// line in the file, 0 if unknown
+	Line int
+	// value set by this origin, only kept for the overridden ones and
+	// filled in by Explain for the last
+	Value string
+}
+
+func (o Origin) String() string {
+	s := o.Provider
+	if len(s) == 0 {
+		s = "set"
+	}
+	if len(o.Source) > 0 {
+		s += " " + o.Source
+	}
+	if o.Line > 0 {
+		s += fmt.Sprintf(":%d", o.Line)
+	}
+	return s
+}
+
+// origin of the values set with Set and SetIn until it's changed again,
+// providers set it before parsing their source, eg.
+// SetOrigin(Origin{Provider: "file", Source: "/etc/app/config.ini"})
+func (t *TreeBuffer) SetOrigin(o Origin) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.origin = o
+}
+
+func (t *TreeBuffer) currentOrigin() Origin {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.origin
+}
+
+// line of the values set next, parsers call it for every line
+func (t *TreeBuffer) setLine(line int) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if len(t.origin.Provider) > 0 {
+		t.origin.Line = line
+	}
+}
+
+// record the origin of the value of name set next, the current value is
+// kept as the value of the origin it overrides. values set without an
+// origin are only recorded if earlier ones were. call it before the
+// value is set, n must belong to the draft
+func (n *node) addOrigin(name string, o Origin) {
+	o.Value = ""
+	k := strings.ToLower(name)
+	if len(o.Provider) == 0 && len(n.origins[k]) == 0 {
+		return
+	}
+	n.mergeOrigins(k, n.data[k], n.origins[k], []Origin{o})
+}
+
+// origin chain of the value of k, the older origins followed by the
+// newer ones. overridden is the value set by the last older origin, the
+// value of the last newer one is the current value. n must belong to
+// the draft
+func (n *node) mergeOrigins(k, overridden string, older, newer []Origin) {
+	if len(older)+len(newer) == 0 {
+		return
+	}
+	if len(newer) == 0 {
+		newer = []Origin{{}}
+	}
+	if n.origins == nil {
+		n.origins = make(map[string][]Origin)
+	}
+	chain := make([]Origin, 0, len(older)+len(newer))
+	chain = append(append(chain, older...), newer...)
+	if len(older) > 0 {
+		chain[len(older)-1].Value = overridden
+	}
+	n.origins[k] = chain
+}
+
+// origins of the value of key, the last one set the current value and
+// overrode the earlier ones. secret values are masked
+func (t *TreeBuffer) Explain(key string) []Origin {
+	ks, berr := lookupKey(key)
+	if berr != nil {
+		return nil
+	}
+	p := t.view().find(ks[:len(ks)-1])
+	if p == nil {
+		return nil
+	}
+	k := ks[len(ks)-1]
+	chain := append([]Origin(nil), p.origins[k]...)
+	if len(chain) > 0 {
+		chain[len(chain)-1].Value = p.data[k]
+	}
+	for i := range chain {
+		chain[i].Value = t.maskValue(key, chain[i].Value)
+	}
+	return chain
+}
+
+// where the value of key came from for errors, default if key isn't set
+func (t *TreeBuffer) explainValue(key string) string {
+	if !t.IsSet(key) {
+		return "default"
+	}
+	if chain := t.Explain(key); len(chain) > 0 {
+		return chain[len(chain)-1].String()
+	}
+	return ""
+}
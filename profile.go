@@ -0,0 +1,73 @@
+package configuration
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// comma separated active profiles, eg. APP_PROFILE=prod,cn-east
+const profileEnv = "APP_PROFILE"
+
+// ini section of values only used with the profile, eg. [profile:prod]
+const profileSection = "profile:"
+
+// buffer key holding the values of a profile section
+func profileKey(profile string) string {
+	return profileSection + strings.ToLower(profile)
+}
+
+func envProfiles() []string {
+	return splitProfiles(os.Getenv(profileEnv))
+}
+
+// comma separated profiles
+func splitProfiles(s string) []string {
+	var profiles []string
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.TrimSpace(p); len(p) > 0 {
+			profiles = append(profiles, p)
+		}
+	}
+	return profiles
+}
+
+// overlay file of the profile, config.ini is config.prod.ini for prod
+func profileFile(filename, profile string) string {
+	ext := filepath.Ext(filename)
+	return strings.TrimSuffix(filename, ext) + "." + profile + ext
+}
+
+// whether the file is the overlay of another one of the files for one
+// of the profiles, eg. config.dev.ini of config.ini for dev. files
+// named like overlays of other profiles are ordinary files
+func isProfileFile(filename string, profiles []string, files map[string]bool) bool {
+	ext := filepath.Ext(filename)
+	name := strings.TrimSuffix(filename, ext)
+	for _, p := range profiles {
+		if base := strings.TrimSuffix(name, "."+p); base != name && files[base+ext] {
+			return true
+		}
+	}
+	return false
+}
+
+// merge the profile sections of the buffer in profile order over the
+// common values and drop all profile sections
+func applyProfiles(buffer *TreeBuffer, profiles []string) {
+	sections := make(map[string]*TreeBuffer)
+	buffer.write(func(root *node) {
+		for k, c := range root.children {
+			if strings.HasPrefix(k, profileSection) {
+				sections[k] = bufferOf(c)
+				delete(root.children, k)
+				delete(root.childNames, k)
+			}
+		}
+	})
+	for _, p := range profiles {
+		if section, ok := sections[profileKey(p)]; ok {
+			buffer.MergeFrom(section, true)
+		}
+	}
+}
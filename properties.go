@@ -0,0 +1,135 @@
+package configuration
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+func init() {
+	RegisterFormat("properties", parseProperties)
+}
+
+// java .properties, key = value, key: value or key value lines,
+// # and ! comments, \uXXXX escapes and backslash continued lines
+func parseProperties(buffer *TreeBuffer, data []byte) error {
+	lines := strings.Split(strings.Replace(string(data), "\r\n", "\n", -1), "\n")
+	for i := 0; i < len(lines); i++ {
+		start := i + 1
+		l := strings.TrimLeft(lines[i], " \t\f")
+		if len(l) == 0 || l[0] == '#' || l[0] == '!' {
+			continue
+		}
+		// an odd number of trailing backslashes continues the line,
+		// leading whitespace of the next line is dropped
+		for trailingBackslashes(l)%2 == 1 {
+			l = l[:len(l)-1]
+			if i+1 == len(lines) {
+				break
+			}
+			i++
+			l += strings.TrimLeft(lines[i], " \t\f")
+		}
+		k, v := splitProperty(l)
+		key, err := unescapeProperty(k)
+		if err != nil {
+			return fmt.Errorf("properties line %d: %v", start, err)
+		}
+		value, err := unescapeProperty(v)
+		if err != nil {
+			return fmt.Errorf("properties line %d: %v", start, err)
+		}
+		// keys and values are literal, keys are only split at dots
+		buffer.setLine(start)
+		buffer.SetIn(strings.Split(key, "."), value)
+	}
+	return nil
+}
+
+func trailingBackslashes(l string) int {
+	n := 0
+	for i := len(l) - 1; i >= 0 && l[i] == '\\'; i-- {
+		n++
+	}
+	return n
+}
+
+// split at the first unescaped =, : or whitespace, the separator
+// may be surrounded by whitespace
+func splitProperty(l string) (string, string) {
+	i := 0
+	for ; i < len(l); i++ {
+		if l[i] == '\\' {
+			i++
+			continue
+		}
+		if l[i] == '=' || l[i] == ':' || l[i] == ' ' || l[i] == '\t' || l[i] == '\f' {
+			break
+		}
+	}
+	if i >= len(l) {
+		return l, ""
+	}
+	k, rest := l[:i], strings.TrimLeft(l[i:], " \t\f")
+	if len(rest) > 0 && (rest[0] == '=' || rest[0] == ':') {
+		rest = strings.TrimLeft(rest[1:], " \t\f")
+	}
+	return k, rest
+}
+
+func unescapeProperty(s string) (string, error) {
+	if !strings.Contains(s, `\`) {
+		return s, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		switch s[i] {
+		case 't':
+			b.WriteByte('\t')
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 'f':
+			b.WriteByte('\f')
+		case 'u':
+			r, err := parseUnicodeEscape(s, i+1)
+			if err != nil {
+				return "", err
+			}
+			i += 4
+			// utf-16 surrogate pair written as two escapes
+			if utf16.IsSurrogate(r) && strings.HasPrefix(s[i+1:], `\u`) {
+				if r2, err := parseUnicodeEscape(s, i+3); err == nil {
+					if pr := utf16.DecodeRune(r, r2); pr != utf8.RuneError {
+						r = pr
+						i += 6
+					}
+				}
+			}
+			b.WriteRune(r)
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String(), nil
+}
+
+// the 4 hex digits at s[i:]
+func parseUnicodeEscape(s string, i int) (rune, error) {
+	if i+4 > len(s) {
+		return 0, fmt.Errorf("malformed \\u escape in %q", s)
+	}
+	r, err := strconv.ParseUint(s[i:i+4], 16, 16)
+	if err != nil {
+		return 0, fmt.Errorf("malformed \\u escape in %q", s)
+	}
+	return rune(r), nil
+}
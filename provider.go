@@ -1,5 +1,71 @@
 package configuration
 
+import (
+	"sort"
+	"sync"
+)
+
 type Provider interface {
 	GetBuffer() (*TreeBuffer, error)
 }
+
+// provider which can fetch its source again
+type Reloader interface {
+	// load the source again, GetBuffer returns the new buffer afterwards
+	Reload() (*TreeBuffer, error)
+}
+
+// provider which can wait for changes of its source
+type Watcher interface {
+	// block until the source changed or stop is closed,
+	// returns false if stopped
+	WaitChange(stop <-chan struct{}) (bool, error)
+}
+
+// create a provider with the param after "scheme::"
+type ProviderFactory func(param string) (Provider, error)
+
+var (
+	providers     = make(map[string]ProviderFactory)
+	providersLock sync.RWMutex
+)
+
+// register a provider factory for "scheme::param" providers,
+// it panics if the scheme is registered twice or factory is nil
+func RegisterProvider(scheme string, factory func(param string) (Provider, error)) {
+	providersLock.Lock()
+	defer providersLock.Unlock()
+	if factory == nil {
+		panic("configuration: RegisterProvider factory is nil")
+	}
+	if _, dup := providers[scheme]; dup {
+		panic("configuration: RegisterProvider called twice for provider " + scheme)
+	}
+	providers[scheme] = factory
+}
+
+// registered provider schemes, sorted
+func Providers() []string {
+	providersLock.RLock()
+	defer providersLock.RUnlock()
+	schemes := make([]string, 0, len(providers))
+	for scheme := range providers {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// remove a registered scheme, for tests registering their own providers
+func unregisterProvider(scheme string) {
+	providersLock.Lock()
+	defer providersLock.Unlock()
+	delete(providers, scheme)
+}
+
+func lookupProvider(scheme string) (ProviderFactory, bool) {
+	providersLock.RLock()
+	defer providersLock.RUnlock()
+	factory, ok := providers[scheme]
+	return factory, ok
+}
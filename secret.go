@@ -0,0 +1,94 @@
+package configuration
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+)
+
+// printed in place of secret values
+const SecretMask = "******"
+
+var (
+	// key patterns of secret values, matched case insensitive with path.Match
+	sensitiveKeys     = []string{"*password*", "*token*", "*secret*"}
+	sensitiveKeysLock sync.RWMutex
+)
+
+// replace the key patterns whose values are masked in String and errors,
+// eg. SetSensitiveKeys("*password*", "*.apikey")
+func SetSensitiveKeys(patterns ...string) {
+	sensitiveKeysLock.Lock()
+	defer sensitiveKeysLock.Unlock()
+	sensitiveKeys = make([]string, len(patterns))
+	for i, p := range patterns {
+		sensitiveKeys[i] = strings.ToLower(p)
+	}
+}
+
+func isSensitiveKey(key string) bool {
+	key = strings.ToLower(key)
+	sensitiveKeysLock.RLock()
+	defer sensitiveKeysLock.RUnlock()
+	for _, p := range sensitiveKeys {
+		if ok, _ := path.Match(p, key); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// mark the value of key as secret, it is masked in String and errors
+// but still readable with the getters. marks of a Sub view are marked
+// on its buffer with the prefix
+func (t *TreeBuffer) MarkSecret(key string) {
+	k := secretKey(key)
+	if t.parent != nil {
+		t.parent.MarkSecret(t.prefix + "." + k)
+	}
+	if t.view().secrets[k] {
+		return
+	}
+	t.write(func(root *node) {
+		if root.secrets == nil {
+			root.secrets = make(map[string]bool)
+		}
+		root.secrets[k] = true
+	})
+}
+
+// whether the value of key is marked secret or matches a sensitive key pattern
+func (t *TreeBuffer) IsSecret(key string) bool {
+	return t.view().secrets[secretKey(key)] || isSensitiveKey(key)
+}
+
+// normalized key path of the secret marks
+func secretKey(key string) string {
+	if ks, err := ParseKey(strings.ToLower(key)); err == nil {
+		return JoinKey(ks...)
+	}
+	return strings.ToLower(key)
+}
+
+func (t *TreeBuffer) maskValue(key, value string) string {
+	if t.IsSecret(key) {
+		return SecretMask
+	}
+	return value
+}
+
+// type error of key, the value is masked if secret
+func (t *TreeBuffer) typeError(key, value string) *BufferError {
+	return t.valueError(errType, key, value)
+}
+
+// error of the value of key with the value's origin, the value is
+// masked if secret
+func (t *TreeBuffer) valueError(err error, key, value string) *BufferError {
+	msg := fmt.Sprintf("%v = %v", key, t.maskValue(key, value))
+	if o := t.explainValue(key); len(o) > 0 {
+		msg += " from " + o
+	}
+	return NewBufferError(err, msg)
+}
@@ -0,0 +1,152 @@
+package configuration
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+var errTag = errors.New("cann't parse the conf tag")
+
+// options of a conf tag, eg. `conf:"wx.hosts,omit,trim,sep(\",\"),default(a,b)"`.
+// the key is the option without parentheses, key case doesn't matter
+// while sep and default keep theirs
+type tagOptions struct {
+	key    string
+	omit   bool
+	secret bool
+	trim   bool
+	sep    string
+	hasSep bool
+	// default() is an explicit empty default
+	def    string
+	hasDef bool
+}
+
+// parse a conf tag. options are separated by commas, arguments of
+// sep(...) and default(...) are either one quoted go string or raw text
+// where \ escapes the next character and parentheses, quotes, brackets
+// and braces nest, so json literals like default(["a,b", "c)"]) work
+func parseTag(tag string) (tagOptions, error) {
+	var opts tagOptions
+	for i := 0; i <= len(tag); i++ {
+		start := i
+		// option name or key, quoted key segments and escapes are kept
+		for quoted := false; i < len(tag); i++ {
+			c := tag[i]
+			if c == '\\' {
+				i++
+				continue
+			}
+			if c == '"' {
+				quoted = !quoted
+			}
+			if !quoted && (c == ',' || c == '(') {
+				break
+			}
+		}
+		if i > len(tag) {
+			return opts, errTag
+		}
+		name := strings.TrimSpace(tag[start:i])
+		if i == len(tag) || tag[i] == ',' {
+			switch {
+			case strings.EqualFold(name, "omit"):
+				opts.omit = true
+			case strings.EqualFold(name, "secret"):
+				opts.secret = true
+			case strings.EqualFold(name, "trim"):
+				opts.trim = true
+			case len(name) > 0:
+				opts.key = name
+			}
+			continue
+		}
+		arg, end, err := tagArg(tag, i+1)
+		if err != nil {
+			return opts, err
+		}
+		switch strings.ToLower(name) {
+		case "default":
+			opts.def, opts.hasDef = arg, true
+		case "sep":
+			opts.sep, opts.hasSep = arg, true
+		default:
+			return opts, errTag
+		}
+		i = end + 1
+		for i < len(tag) && tag[i] == ' ' {
+			i++
+		}
+		if i < len(tag) && tag[i] != ',' {
+			return opts, errTag
+		}
+	}
+	return opts, nil
+}
+
+// argument starting at tag[i] and the index of its closing parenthesis
+func tagArg(tag string, i int) (string, int, error) {
+	if rest := strings.TrimLeft(tag[i:], " "); strings.HasPrefix(rest, `"`) {
+		if q, err := strconv.QuotedPrefix(rest); err == nil {
+			end := len(tag) - len(rest) + len(q)
+			for end < len(tag) && tag[end] == ' ' {
+				end++
+			}
+			if end < len(tag) && tag[end] == ')' {
+				s, _ := strconv.Unquote(q)
+				return s, end, nil
+			}
+		}
+	}
+	var (
+		b      strings.Builder
+		depth  int
+		quoted bool
+	)
+	for ; i < len(tag); i++ {
+		c := tag[i]
+		switch {
+		case c == '\\' && i+1 < len(tag):
+			// json strings keep their escapes
+			if quoted {
+				b.WriteByte(c)
+			}
+			i++
+			c = tag[i]
+		case c == '"':
+			quoted = !quoted
+		case quoted:
+		case c == '(' || c == '[' || c == '{':
+			depth++
+		case c == ']' || c == '}':
+			depth--
+		case c == ')':
+			if depth == 0 {
+				return b.String(), i, nil
+			}
+			depth--
+		}
+		b.WriteByte(c)
+	}
+	return "", 0, errTag
+}
+
+// buffer holding the json literal def at key, defaults of struct
+// slices and maps are read from it
+func jsonDefault(key, def string) (*TreeBuffer, *BufferError) {
+	ks, berr := lookupKey(key)
+	if berr != nil {
+		return nil, berr
+	}
+	var v interface{}
+	d := json.NewDecoder(strings.NewReader(def))
+	d.UseNumber()
+	if err := d.Decode(&v); err != nil {
+		return nil, NewBufferError(errTag, key+" default("+def+")")
+	}
+	b := NewTreeBuffer()
+	setNested(b, ks, v)
+	return b, nil
+}
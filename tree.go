@@ -0,0 +1,262 @@
+package configuration
+
+import (
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// a level of the tree, immutable once published as part of a snapshot.
+// values and children are keyed by lower case keys
+type node struct {
+	data      map[string]string
+	dataNames map[string]string
+	// values before Set removed their quotes, see unquoteValue
+	quoted     map[string]string
+	children   map[string]*node
+	childNames map[string]string
+	// origins of the values, see Explain
+	origins map[string][]Origin
+	// full keys marked secret, only used on the root
+	secrets map[string]bool
+	// draft the node belongs to, nodes of other drafts are copied on write
+	epoch uint64
+}
+
+// epochs of drafts, unique across all buffers so nodes shared by
+// MergeFrom are never changed in place
+var draftEpochs uint64
+
+func newNode(epoch uint64) *node {
+	return &node{
+		data:     make(map[string]string),
+		children: make(map[string]*node),
+		epoch:    epoch,
+	}
+}
+
+// shallow copy of n for a draft, children are shared until written
+func (n *node) copy(epoch uint64) *node {
+	c := &node{
+		data:     make(map[string]string, len(n.data)),
+		children: make(map[string]*node, len(n.children)),
+		epoch:    epoch,
+	}
+	for k, v := range n.data {
+		c.data[k] = v
+	}
+	for k, v := range n.children {
+		c.children[k] = v
+	}
+	c.dataNames = copyStrings(n.dataNames)
+	c.quoted = copyStrings(n.quoted)
+	c.childNames = copyStrings(n.childNames)
+	if n.origins != nil {
+		c.origins = make(map[string][]Origin, len(n.origins))
+		for k, v := range n.origins {
+			c.origins[k] = v
+		}
+	}
+	if n.secrets != nil {
+		c.secrets = make(map[string]bool, len(n.secrets))
+		for k := range n.secrets {
+			c.secrets[k] = true
+		}
+	}
+	return c
+}
+
+func copyStrings(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	c := make(map[string]string, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+// node of the path, nil if missing
+func (n *node) find(ks []string) *node {
+	for _, k := range ks {
+		if n = n.children[strings.ToLower(k)]; n == nil {
+			return nil
+		}
+	}
+	return n
+}
+
+// set value of the name, n must belong to the draft
+func (n *node) setData(name, value string) {
+	k := strings.ToLower(name)
+	n.data[k] = value
+	if k != name {
+		if n.dataNames == nil {
+			n.dataNames = make(map[string]string)
+		}
+		n.dataNames[k] = name
+	} else if n.dataNames != nil {
+		delete(n.dataNames, k)
+	}
+	delete(n.quoted, k)
+}
+
+// keep the quoted value of the name set with setData, n must belong to
+// the draft
+func (n *node) setQuoted(name, quoted string) {
+	if n.quoted == nil {
+		n.quoted = make(map[string]string)
+	}
+	n.quoted[strings.ToLower(name)] = quoted
+}
+
+// child of the name in the draft epoch, created if missing and copied
+// if it belongs to a snapshot, n must belong to the draft
+func (n *node) child(name string, epoch uint64) *node {
+	k := strings.ToLower(name)
+	c, ok := n.children[k]
+	if !ok {
+		c = newNode(epoch)
+		n.setChild(name, c)
+	} else if c.epoch != epoch {
+		c = c.copy(epoch)
+		n.children[k] = c
+	}
+	return c
+}
+
+// set child of the name, n must belong to the draft
+func (n *node) setChild(name string, c *node) {
+	k := strings.ToLower(name)
+	n.children[k] = c
+	if k != name {
+		if n.childNames == nil {
+			n.childNames = make(map[string]string)
+		}
+		n.childNames[k] = name
+	}
+}
+
+// name of the data key as set
+func (n *node) dataName(k string) string {
+	if name, ok := n.dataNames[k]; ok {
+		return name
+	}
+	return k
+}
+
+// name of the child key as set
+func (n *node) childName(k string) string {
+	if name, ok := n.childNames[k]; ok {
+		return name
+	}
+	return k
+}
+
+// merge the values of src, existing values are replaced if cover is
+// set. n must belong to the draft, children of src are shared
+func (n *node) merge(src *node, cover bool, epoch uint64) {
+	for k, v := range src.data {
+		if _, ok := n.data[k]; !ok || cover {
+			n.mergeOrigins(k, n.data[k], n.origins[k], src.origins[k])
+			n.setData(src.dataName(k), v)
+			if q, ok := src.quoted[k]; ok {
+				n.setQuoted(k, q)
+			}
+		} else {
+			// src's value was overridden by n's
+			n.mergeOrigins(k, n.data[k], src.origins[k], n.origins[k])
+		}
+	}
+	for k, c := range src.children {
+		if _, ok := n.children[k]; !ok || (cover && c.isList()) {
+			// a list replaces the elements of the older one
+			n.setChild(src.childName(k), c)
+		} else {
+			n.child(k, epoch).merge(c, cover, epoch)
+		}
+	}
+}
+
+// whether the keys of n are the indexes 0 to len-1, like key.0, key.1
+func (n *node) isList() bool {
+	size := len(n.data) + len(n.children)
+	if size == 0 {
+		return false
+	}
+	keys := make(map[string]bool, size)
+	for k := range n.data {
+		keys[k] = true
+	}
+	for k := range n.children {
+		keys[k] = true
+	}
+	for i := 0; i < size; i++ {
+		if !keys[strconv.Itoa(i)] {
+			return false
+		}
+	}
+	return true
+}
+
+// call fn with the path and value of every value under n
+func (n *node) each(ks []string, fn func(ks []string, value string)) {
+	for k, v := range n.data {
+		fn(append(ks[:len(ks):len(ks)], n.dataName(k)), v)
+	}
+	for k, c := range n.children {
+		c.each(append(ks[:len(ks):len(ks)], n.childName(k)), fn)
+	}
+}
+
+// buffer of the snapshot n
+func bufferOf(n *node) *TreeBuffer {
+	t := &TreeBuffer{}
+	t.snapshot.Store(n)
+	return t
+}
+
+// buffer of the snapshot n with the list format of t
+func (t *TreeBuffer) derive(n *node) *TreeBuffer {
+	b := bufferOf(n)
+	b.listFormat = t.currentListFormat()
+	return b
+}
+
+// the current snapshot, the draft is published first if there were
+// writes since the last read
+func (t *TreeBuffer) view() *node {
+	if n := t.snapshot.Load(); n != nil {
+		return n
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if n := t.snapshot.Load(); n != nil {
+		return n
+	}
+	n := t.draft
+	if n == nil {
+		n = newNode(0)
+	}
+	t.snapshot.Store(n)
+	t.draft = nil
+	return n
+}
+
+// change the draft root, copied from the snapshot if there is none.
+// the snapshot is cleared so the next read publishes the draft
+func (t *TreeBuffer) write(fn func(root *node)) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.draft == nil {
+		t.epoch = atomic.AddUint64(&draftEpochs, 1)
+		if n := t.snapshot.Load(); n != nil {
+			t.draft = n.copy(t.epoch)
+		} else {
+			t.draft = newNode(t.epoch)
+		}
+	}
+	fn(t.draft)
+	t.snapshot.Store(nil)
+}
@@ -0,0 +1,182 @@
+package configuration
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// whether key has a value or children
+func (t *TreeBuffer) Has(key string) bool {
+	ks, berr := lookupKey(key)
+	if berr != nil {
+		return false
+	}
+	if _, err := t.GetIn(ks); err != errKeyNotFound {
+		return true
+	}
+	return t.hasChildBuffer(key)
+}
+
+// whether key has a value, possibly empty. keys with only children
+// like wx in wx.oracle.host aren't set
+func (t *TreeBuffer) IsSet(key string) bool {
+	ks, berr := lookupKey(key)
+	if berr != nil {
+		return false
+	}
+	_, err := t.GetIn(ks)
+	return err != errKeyNotFound
+}
+
+type keyValue struct {
+	ks    []string
+	key   string
+	value string
+}
+
+// values of the snapshot root sorted by key, keys are joined with JoinKey
+func sortedValues(root *node) []keyValue {
+	var kvs []keyValue
+	root.each(nil, func(ks []string, value string) {
+		kvs = append(kvs, keyValue{ks, JoinKey(ks...), value})
+	})
+	sort.Slice(kvs, func(i, j int) bool { return compareKeys(kvs[i].ks, kvs[j].ks) < 0 })
+	return kvs
+}
+
+// order of the key paths by segments, numeric segments by number so
+// list.2 comes before list.10
+func compareKeys(a, b []string) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if c := compareSegments(JoinKey(a[i]), JoinKey(b[i])); c != 0 {
+			return c
+		}
+	}
+	return len(a) - len(b)
+}
+
+func compareSegments(a, b string) int {
+	if isIndex(a) && isIndex(b) {
+		na, nb := strings.TrimLeft(a, "0"), strings.TrimLeft(b, "0")
+		if len(na) != len(nb) {
+			return len(na) - len(nb)
+		}
+		if c := strings.Compare(na, nb); c != 0 {
+			return c
+		}
+	}
+	return strings.Compare(a, b)
+}
+
+func isIndex(s string) bool {
+	if len(s) == 0 {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// sorted keys of all values under prefix, all keys if prefix is empty
+func (t *TreeBuffer) Keys(prefix string) []string {
+	var pks []string
+	if len(prefix) > 0 {
+		var berr *BufferError
+		if pks, berr = lookupKey(prefix); berr != nil {
+			return []string{}
+		}
+	}
+	keys := []string{}
+	for _, kv := range sortedValues(t.view()) {
+		if hasKeyPrefix(kv.ks, pks) {
+			keys = append(keys, kv.key)
+		}
+	}
+	return keys
+}
+
+// whether the lower case segments pks start ks
+func hasKeyPrefix(ks, pks []string) bool {
+	if len(pks) > len(ks) {
+		return false
+	}
+	for i, k := range pks {
+		if strings.ToLower(ks[i]) != k {
+			return false
+		}
+	}
+	return true
+}
+
+// call fn with every key and value sorted by key, file references are
+// resolved. walking stops at the first error of fn which is returned.
+// fn may read and change the buffer
+func (t *TreeBuffer) Walk(fn func(key, value string) error) error {
+	root := t.view()
+	for _, kv := range sortedValues(root) {
+		last := strings.ToLower(kv.ks[len(kv.ks)-1])
+		v, err := root.find(kv.ks[:len(kv.ks)-1]).resolve(last, kv.value)
+		if err != nil {
+			return NewBufferError(err, kv.key)
+		}
+		if err = fn(kv.key, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Walk with the values as set, file references aren't resolved
+func (t *TreeBuffer) WalkRaw(fn func(key, value string) error) error {
+	for _, kv := range sortedValues(t.view()) {
+		if err := fn(kv.key, kv.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// all values as nested maps keyed by the names as set, indexed children
+// (key.0, key.1, ...) become slices and file references are resolved.
+// a value and children of the same key can't both be represented,
+// the children are kept
+func (t *TreeBuffer) AllSettings() map[string]interface{} {
+	return t.view().settings()
+}
+
+func (n *node) settings() map[string]interface{} {
+	m := make(map[string]interface{})
+	for k, v := range n.data {
+		if _, ok := n.children[k]; ok {
+			continue
+		}
+		if rv, err := n.resolve(k, v); err == nil {
+			v = rv
+		}
+		m[n.dataName(k)] = v
+	}
+	for k, c := range n.children {
+		m[n.childName(k)] = asSlice(c.settings())
+	}
+	return m
+}
+
+// the elements of m if its keys are 0 to len(m)-1, m otherwise
+func asSlice(m map[string]interface{}) interface{} {
+	if len(m) == 0 {
+		return m
+	}
+	s := make([]interface{}, len(m))
+	for k, v := range m {
+		i, err := strconv.Atoi(k)
+		if err != nil || i < 0 || i >= len(s) || strconv.Itoa(i) != k {
+			return m
+		}
+		s[i] = v
+	}
+	return s
+}